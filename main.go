@@ -2,15 +2,285 @@ package main
 
 import (
 	"fmt"
+	"io"
 	"log"
-	"net/url"
+	"net/http"
 	"os"
+	"sync"
 
 	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/credentials"
 	"github.com/codegangsta/cli"
 	"github.com/oremj/parallel-s3sync/s3sync"
 )
 
+// commonFlags apply to every command.
+var commonFlags = []cli.Flag{
+	cli.IntFlag{
+		Name:  "workers",
+		Value: 16,
+		Usage: "Set amount of parallel uploads",
+	},
+	cli.BoolFlag{
+		Name:  "debug",
+		Usage: "verbose logging",
+	},
+	cli.IntFlag{
+		Name:  "loglevel",
+		Value: 0,
+		Usage: "Sets aws-sdk-go log level",
+	},
+	cli.StringFlag{
+		Name:  "metrics-addr",
+		Usage: "serve Prometheus metrics on this address, e.g. :9100",
+	},
+	cli.StringFlag{
+		Name:  "output",
+		Value: "text",
+		Usage: "text, or json to write one JSON event per sync decision and transfer",
+	},
+	cli.StringFlag{
+		Name:  "output-file",
+		Value: "-",
+		Usage: "file the json output is written to, - for stdout",
+	},
+	cli.StringFlag{
+		Name:   "endpoint-url",
+		Usage:  "S3 endpoint, e.g. http://localhost:9000 for MinIO",
+		EnvVar: "S3SYNC_ENDPOINT_URL",
+	},
+	cli.StringFlag{
+		Name:   "region",
+		Usage:  "AWS region",
+		EnvVar: "AWS_REGION,AWS_DEFAULT_REGION",
+	},
+	cli.BoolFlag{
+		Name:   "force-path-style",
+		Usage:  "use path-style instead of virtual-hosted-style bucket addressing",
+		EnvVar: "S3SYNC_FORCE_PATH_STYLE",
+	},
+	cli.BoolFlag{
+		Name:   "no-verify-ssl",
+		Usage:  "do not verify the endpoint's TLS certificate",
+		EnvVar: "S3SYNC_NO_VERIFY_SSL",
+	},
+	cli.StringFlag{
+		Name:   "ca-bundle",
+		Usage:  "PEM file of CA certificates to verify the endpoint with",
+		EnvVar: "AWS_CA_BUNDLE",
+	},
+	cli.StringFlag{
+		Name:   "profile",
+		Usage:  "profile in the shared credentials file",
+		EnvVar: "AWS_PROFILE",
+	},
+	cli.StringFlag{
+		Name:   "credentials-file",
+		Usage:  "shared credentials file, defaults to ~/.aws/credentials",
+		EnvVar: "AWS_SHARED_CREDENTIALS_FILE",
+	},
+	cli.StringFlag{
+		Name:  "sse-c-key-file",
+		Usage: "file holding a 256 bit SSE-C customer key, raw or base64 encoded",
+	},
+	cli.StringFlag{
+		Name:  "encryption-key-file",
+		Usage: "encrypt uploads and decrypt downloads client side with this 256 bit master key",
+	},
+}
+
+// uploadFlags control how files are uploaded.
+var uploadFlags = []cli.Flag{
+	cli.BoolFlag{
+		Name:  "copy-symlinks",
+		Usage: "copy, but do not follow symlinks",
+	},
+	cli.BoolFlag{
+		Name:  "update-metadata",
+		Usage: "refresh mode/uid/gid metadata of unchanged files in place (one HEAD per file)",
+	},
+	cli.BoolFlag{
+		Name:  "verify",
+		Usage: "HEAD each uploaded object and fail if its size, md5 or metadata differ",
+	},
+	cli.IntFlag{
+		Name:  "unstable-retries",
+		Value: s3sync.DefaultUnstableRetries,
+		Usage: "upload a file that changed while it was uploaded again up to this many times",
+	},
+	cli.IntFlag{
+		Name:  "snapshot-size",
+		Usage: "read files up to this many bytes into memory before uploading them",
+	},
+	cli.StringFlag{
+		Name:  "rules",
+		Usage: "JSON file of glob pattern rules setting headers and metadata",
+	},
+	cli.StringSliceFlag{
+		Name:  "mime-types",
+		Usage: "load extra extension to content type mappings from a mime.types file",
+		Value: &cli.StringSlice{},
+	},
+	cli.BoolFlag{
+		Name:  "sniff-content-type",
+		Usage: "detect the content type of files with an unknown extension from their contents",
+	},
+	cli.BoolFlag{
+		Name:  "charset-utf8",
+		Usage: "append \"; charset=utf-8\" to text content types",
+	},
+	cli.BoolFlag{
+		Name:  "gzip",
+		Usage: "gzip .js, .css, .html and .svg files and set Content-Encoding",
+	},
+	cli.StringSliceFlag{
+		Name:  "gzip-pattern",
+		Usage: "gzip files matching the pattern instead of the --gzip defaults",
+		Value: &cli.StringSlice{},
+	},
+	cli.StringFlag{
+		Name:  "compression",
+		Usage: "Content-Encoding of --gzip and --gzip-pattern files: gzip or br",
+		Value: s3sync.CompressionGzip,
+	},
+	cli.StringFlag{
+		Name:  "sse",
+		Usage: "server-side encryption: AES256 or aws:kms",
+	},
+	cli.StringFlag{
+		Name:  "sse-kms-key-id",
+		Usage: "KMS key id for aws:kms server-side encryption",
+	},
+	cli.StringFlag{
+		Name:  "storage-class",
+		Usage: "storage class of uploaded objects, e.g. STANDARD_IA",
+	},
+	cli.StringFlag{
+		Name:  "acl",
+		Usage: "canned ACL of uploaded objects, e.g. bucket-owner-full-control",
+	},
+	cli.StringSliceFlag{
+		Name:  "tag",
+		Usage: "key=value tag set on uploaded objects",
+		Value: &cli.StringSlice{},
+	},
+	cli.StringSliceFlag{
+		Name:  "exclude",
+		Usage: "Matches based on http://golang.org/pkg/path/filepath/#Match",
+		Value: &cli.StringSlice{},
+	},
+	cli.StringSliceFlag{
+		Name:  "exclude-dir",
+		Usage: "skip directories with this path, or this name anywhere. No trailing /",
+		Value: &cli.StringSlice{},
+	},
+}
+
+var configFlag = cli.StringFlag{
+	Name:  "config",
+	Usage: "YAML or JSON file declaring sync jobs to run instead of <source> <target>",
+}
+
+var watchFlags = []cli.Flag{
+	cli.BoolFlag{
+		Name:  "watch",
+		Usage: "keep running after the sync and upload local files as they change",
+	},
+	cli.BoolFlag{
+		Name:  "watch-delete",
+		Usage: "with --watch, delete the keys of removed files",
+	},
+	cli.DurationFlag{
+		Name:  "watch-delay",
+		Value: s3sync.DefaultWatchDelay,
+		Usage: "with --watch, how long changes must settle before uploading",
+	},
+}
+
+var retryFlags = []cli.Flag{
+	cli.IntFlag{
+		Name:  "retries",
+		Value: s3sync.DefaultRetries,
+		Usage: "retry uploads that fail with a network, 5xx or throttling error up to this many times",
+	},
+	cli.DurationFlag{
+		Name:  "retry-delay",
+		Value: s3sync.DefaultRetryDelay,
+		Usage: "delay before the first retry, doubled for each further retry",
+	},
+	cli.IntFlag{
+		Name:  "max-errors",
+		Usage: "abort once this many files failed",
+	},
+	cli.Float64Flag{
+		Name:  "max-error-rate",
+		Usage: "abort once more than this fraction of finished files failed, e.g. 0.1",
+	},
+	cli.StringFlag{
+		Name:  "failed-list",
+		Usage: "write the files that still failed to this file, one per line",
+	},
+}
+
+var filesFromFlag = cli.StringFlag{
+	Name:  "files-from",
+	Usage: "only sync the files listed in this file, such as a --failed-list",
+}
+
+var maxChangesFlags = []cli.Flag{
+	cli.IntFlag{
+		Name:  "max-changes",
+		Usage: "refuse to overwrite or delete more than this many existing objects",
+	},
+	cli.Float64Flag{
+		Name:  "max-changes-percent",
+		Usage: "refuse to overwrite or delete more than this percentage of existing objects",
+	},
+}
+
+var deleteFlags = flags([]cli.Flag{
+	cli.BoolFlag{
+		Name:  "delete",
+		Usage: "delete objects under the target that have no local file",
+	},
+}, maxChangesFlags, []cli.Flag{
+	cli.BoolFlag{
+		Name:  "force",
+		Usage: "sync even if --max-changes or --max-changes-percent is exceeded",
+	},
+})
+
+var rmFlags = flags([]cli.Flag{dryRunFlag}, maxChangesFlags, []cli.Flag{
+	cli.BoolFlag{
+		Name:  "force",
+		Usage: "delete even if the path is a whole bucket or --max-changes or --max-changes-percent is exceeded",
+	},
+})
+
+var phaseFlag = cli.StringSliceFlag{
+	Name:  "phase",
+	Usage: "upload files matching these comma separated patterns after all others, e.g. '*.html'. Repeat for more phases",
+	Value: &cli.StringSlice{},
+}
+
+var manifestFlag = cli.StringFlag{
+	Name:  "manifest",
+	Usage: "after a successful upload, write a sha256sums or json checksum manifest to the target",
+}
+
+var dryRunFlag = cli.BoolFlag{
+	Name:  "dry-run",
+	Usage: "print what would be done without changing anything",
+}
+
+func flags(groups ...[]cli.Flag) []cli.Flag {
+	all := []cli.Flag{}
+	for _, group := range groups {
+		all = append(all, group...)
+	}
+	return all
+}
+
 func main() {
 
 	log.SetFlags(log.Lshortfile | log.LstdFlags)
@@ -19,69 +289,619 @@ func main() {
 	app.Name = "parallel-s3sync"
 	app.Usage = "<source> <target>"
 	app.Version = "1.0.1"
-	app.Flags = []cli.Flag{
-		cli.IntFlag{
-			Name:  "workers",
-			Value: 16,
-			Usage: "Set amount of parallel uploads",
+	syncFlags := flags(commonFlags, uploadFlags, deleteFlags, []cli.Flag{phaseFlag}, retryFlags, []cli.Flag{filesFromFlag}, watchFlags, []cli.Flag{manifestFlag, configFlag})
+	app.Flags = syncFlags
+	app.Action = runSync
+	app.Commands = []cli.Command{
+		{
+			Name:   "sync",
+			Usage:  "<source> <target> sync a local directory to S3 or back",
+			Flags:  syncFlags,
+			Action: runSync,
+		},
+		{
+			Name:   "diff",
+			Usage:  "<source> <target> print what sync would transfer",
+			Flags:  flags(commonFlags, uploadFlags, deleteFlags, []cli.Flag{manifestFlag}),
+			Action: runDiff,
+		},
+		{
+			Name:  "plan",
+			Usage: "<source> <target> -o <plan file> save what sync would do for review",
+			Flags: flags(commonFlags, uploadFlags, deleteFlags, []cli.Flag{
+				phaseFlag,
+				cli.StringFlag{
+					Name:  "out, o",
+					Usage: "file to write the plan to",
+				},
+			}),
+			Action: runPlan,
+		},
+		{
+			Name:   "apply",
+			Usage:  "<plan file> run a saved plan if nothing changed since",
+			Flags:  flags(commonFlags, uploadFlags, deleteFlags, retryFlags),
+			Action: runApply,
+		},
+		{
+			Name:  "release",
+			Usage: "<source> <target> upload a new release below <target>/releases/ and make it current",
+			Flags: flags(commonFlags, uploadFlags, []cli.Flag{phaseFlag}, retryFlags, []cli.Flag{
+				manifestFlag,
+				dryRunFlag,
+				cli.StringFlag{
+					Name:  "id",
+					Usage: "id of the release, defaults to the current UTC time",
+				},
+				cli.IntFlag{
+					Name:  "keep",
+					Usage: "delete all but this many of the newest releases afterwards",
+				},
+			}),
+			Action: runRelease,
 		},
-		cli.BoolFlag{
-			Name:  "copy-symlinks",
-			Usage: "copy, but do not follow symlinks",
+		{
+			Name:   "rollback",
+			Usage:  "<target> <id> make an earlier release current again",
+			Flags:  flags(commonFlags, []cli.Flag{dryRunFlag}),
+			Action: runRollback,
 		},
-		cli.BoolFlag{
-			Name:  "debug",
-			Usage: "verbose logging",
+		{
+			Name:  "snapshots",
+			Usage: "create, list or restore incremental snapshots",
+			Subcommands: []cli.Command{
+				{
+					Name:   "create",
+					Usage:  "<source> <target> upload a new snapshot below <target>",
+					Flags:  flags(commonFlags, uploadFlags, retryFlags, []cli.Flag{dryRunFlag}),
+					Action: runSnapshotCreate,
+				},
+				{
+					Name:   "list",
+					Usage:  "<target> list the snapshots below <target>",
+					Flags:  commonFlags,
+					Action: runSnapshotList,
+				},
+				{
+					Name:   "restore",
+					Usage:  "<target> <id> <dir> download a snapshot to a local directory",
+					Flags:  commonFlags,
+					Action: runSnapshotRestore,
+				},
+			},
 		},
-		cli.IntFlag{
-			Name:  "loglevel",
-			Value: 0,
-			Usage: "Sets aws-sdk-go log level",
+		{
+			Name:  "cas",
+			Usage: "upload or download a tree of content addressed blobs",
+			Subcommands: []cli.Command{
+				{
+					Name:  "put",
+					Usage: "<source> <target> upload new blobs and a manifest below <target>",
+					Flags: flags(commonFlags, uploadFlags, retryFlags, []cli.Flag{
+						dryRunFlag,
+						cli.StringFlag{
+							Name:  "name",
+							Usage: "name of the manifest, defaults to the current UTC time",
+						},
+					}),
+					Action: runCASPut,
+				},
+				{
+					Name:   "get",
+					Usage:  "<target> <name> <dir> download the tree of a manifest to a local directory",
+					Flags:  commonFlags,
+					Action: runCASGet,
+				},
+			},
 		},
-		cli.StringSliceFlag{
-			Name:  "exclude",
-			Usage: "Matches based on http://golang.org/pkg/path/filepath/#Match",
-			Value: &cli.StringSlice{},
+		{
+			Name:   "ls",
+			Usage:  "<s3path> list objects",
+			Flags:  commonFlags,
+			Action: runLs,
 		},
-		cli.StringSliceFlag{
-			Name:  "exclude-dir",
-			Usage: "if the directory matches, skip. No trailing /",
-			Value: &cli.StringSlice{},
+		{
+			Name:   "du",
+			Usage:  "<s3path> count objects and sum their sizes",
+			Flags:  commonFlags,
+			Action: runDu,
+		},
+		{
+			Name:   "cp",
+			Usage:  "<source> <target> copy a single file or key",
+			Flags:  flags(commonFlags, uploadFlags),
+			Action: runCp,
+		},
+		{
+			Name:   "rm",
+			Usage:  "<s3path> delete every object under a path",
+			Flags:  flags(commonFlags, rmFlags),
+			Action: runRm,
 		},
 	}
 
-	app.Action = func(c *cli.Context) {
-		if len(c.Args()) < 2 {
-			fmt.Println("<source> and <target> required")
-			os.Exit(1)
+	app.Run(os.Args)
+}
+
+// setup applies the flags that configure the s3sync package globally.
+func setup(c *cli.Context) {
+	s3sync.Debug = c.Bool("debug")
+	for _, f := range c.StringSlice("mime-types") {
+		if err := s3sync.LoadMimeTypes(f); err != nil {
+			log.Fatal(err)
 		}
-		source, target := c.Args()[0], c.Args()[1]
-		workers := c.Int("workers")
-		copySymlinks := c.Bool("copy-symlinks")
-		s3sync.Debug = c.Bool("debug")
-		excludes := c.StringSlice("exclude")
-		excludeDirs := c.StringSlice("exclude-dir")
+	}
+}
+
+func args(c *cli.Context, n int, usage string) []string {
+	if len(c.Args()) < n {
+		fmt.Println(usage + " required")
+		os.Exit(1)
+	}
+	return c.Args()
+}
+
+func runSync(c *cli.Context) {
+	setup(c)
 
-		s3Url, err := url.Parse(c.Args()[1])
-		if s3Url.Scheme != "s3" || s3Url.Host == "" || s3Url.Path == "" {
-			log.Fatal("Not a valid s3_path. Example: s3://bucket/path")
+	if configFile := c.String("config"); configFile != "" {
+		runConfig(c, configFile)
+		return
+	}
+
+	a := args(c, 2, "<source> and <target>")
+	source, target := a[0], a[1]
+	workers := c.Int("workers")
+
+	sync := newSync(c)
+	retrySettings(c, sync)
+	if filesFrom := c.String("files-from"); filesFrom != "" {
+		files, err := s3sync.LoadFileList(filesFrom)
+		if err != nil {
+			log.Fatal(err)
 		}
+		// An empty list syncs nothing rather than everything.
+		sync.FilesFrom = append([]string{}, files...)
+	}
+	sync.Watch = c.Bool("watch")
+	sync.WatchDelete = c.Bool("watch-delete")
+	sync.WatchDelay = c.Duration("watch-delay")
+
+	err := sync.Sync(source, target, workers)
+	if err != nil {
+		log.Fatal(err)
+	}
+}
 
-		sync := s3sync.New(&aws.Config{
-			MaxRetries: aws.Int(5),
-			LogLevel:   aws.LogLevel(aws.LogLevelType((c.Int("loglevel")))),
-		})
+// retrySettings applies the retryFlags.
+func retrySettings(c *cli.Context, sync *s3sync.S3Sync) {
+	sync.Retries = c.Int("retries")
+	sync.RetryDelay = c.Duration("retry-delay")
+	sync.MaxErrors = c.Int("max-errors")
+	sync.MaxErrorRate = c.Float64("max-error-rate")
+	sync.FailedList = c.String("failed-list")
+}
 
-		for _, d := range excludeDirs {
-			sync.ExcludeDirectories[d] = true
+func runPlan(c *cli.Context) {
+	setup(c)
+	a := args(c, 2, "<source> and <target>")
+	planFile := c.String("out")
+	if planFile == "" {
+		fmt.Println("-o <plan file> required")
+		os.Exit(1)
+	}
+
+	plan, err := newSync(c).Plan(a[0], a[1], c.Int("workers"))
+	if err != nil {
+		log.Fatal(err)
+	}
+	if err := s3sync.WritePlan(planFile, plan); err != nil {
+		log.Fatal(err)
+	}
+}
+
+func runApply(c *cli.Context) {
+	setup(c)
+	a := args(c, 1, "<plan file>")
+
+	plan, err := s3sync.LoadPlan(a[0])
+	if err != nil {
+		log.Fatal(err)
+	}
+	sync := newSync(c)
+	retrySettings(c, sync)
+	if err := sync.Apply(plan, c.Int("workers")); err != nil {
+		log.Fatal(err)
+	}
+}
+
+func runRelease(c *cli.Context) {
+	setup(c)
+	a := args(c, 2, "<source> and <target>")
+
+	sync := newSync(c)
+	retrySettings(c, sync)
+	sync.DryRun = c.Bool("dry-run")
+	sync.KeepReleases = c.Int("keep")
+	id := c.String("id")
+	if id == "" {
+		id = s3sync.NewTimeID()
+	}
+	if err := sync.Release(a[0], a[1], id, c.Int("workers")); err != nil {
+		log.Fatal(err)
+	}
+}
+
+func runRollback(c *cli.Context) {
+	setup(c)
+	a := args(c, 2, "<target> and <id>")
+
+	sync := newSync(c)
+	sync.DryRun = c.Bool("dry-run")
+	if err := sync.Rollback(a[0], a[1]); err != nil {
+		log.Fatal(err)
+	}
+}
+
+func runSnapshotCreate(c *cli.Context) {
+	setup(c)
+	a := args(c, 2, "<source> and <target>")
+
+	sync := newSync(c)
+	retrySettings(c, sync)
+	sync.DryRun = c.Bool("dry-run")
+	if _, err := sync.Snapshot(a[0], a[1], c.Int("workers")); err != nil {
+		log.Fatal(err)
+	}
+}
+
+func runSnapshotList(c *cli.Context) {
+	setup(c)
+	a := args(c, 1, "<target>")
+
+	snapshots, err := newSync(c).Snapshots(a[0])
+	if err != nil {
+		log.Fatal(err)
+	}
+	for _, sn := range snapshots {
+		total, stored := sn.Size()
+		fmt.Printf("%s\t%d files\t%d bytes\t%d bytes new\n", sn.ID, len(sn.Files), total, stored)
+	}
+}
+
+func runSnapshotRestore(c *cli.Context) {
+	setup(c)
+	a := args(c, 3, "<target>, <id> and <dir>")
+
+	if err := newSync(c).Restore(a[0], a[1], a[2], c.Int("workers")); err != nil {
+		log.Fatal(err)
+	}
+}
+
+func runCASPut(c *cli.Context) {
+	setup(c)
+	a := args(c, 2, "<source> and <target>")
+
+	sync := newSync(c)
+	retrySettings(c, sync)
+	sync.DryRun = c.Bool("dry-run")
+	name := c.String("name")
+	if name == "" {
+		name = s3sync.NewTimeID()
+	}
+	if _, err := sync.PutCAS(a[0], a[1], name, c.Int("workers")); err != nil {
+		log.Fatal(err)
+	}
+}
+
+func runCASGet(c *cli.Context) {
+	setup(c)
+	a := args(c, 3, "<target>, <name> and <dir>")
+
+	if err := newSync(c).GetCAS(a[0], a[1], a[2], c.Int("workers")); err != nil {
+		log.Fatal(err)
+	}
+}
+
+func runDiff(c *cli.Context) {
+	setup(c)
+	a := args(c, 2, "<source> and <target>")
+
+	sync := newSync(c)
+	sync.DryRun = true
+	if err := sync.Sync(a[0], a[1], c.Int("workers")); err != nil {
+		log.Fatal(err)
+	}
+}
+
+func runLs(c *cli.Context) {
+	setup(c)
+	a := args(c, 1, "<s3path>")
+
+	_, objects, err := newSync(c).List(a[0])
+	if err != nil {
+		log.Fatal(err)
+	}
+	for _, o := range objects {
+		fmt.Printf("%s %12d %s\n", o.LastModified.Format("2006-01-02 15:04:05"), *o.Size, *o.Key)
+	}
+}
+
+func runDu(c *cli.Context) {
+	setup(c)
+	a := args(c, 1, "<s3path>")
+
+	_, objects, err := newSync(c).List(a[0])
+	if err != nil {
+		log.Fatal(err)
+	}
+	var size int64
+	for _, o := range objects {
+		size += *o.Size
+	}
+	fmt.Printf("%d objects\t%d bytes\t%s\n", len(objects), size, a[0])
+}
+
+func runCp(c *cli.Context) {
+	setup(c)
+	a := args(c, 2, "<source> and <target>")
+
+	if err := newSync(c).Copy(a[0], a[1]); err != nil {
+		log.Fatal(err)
+	}
+}
+
+func runRm(c *cli.Context) {
+	setup(c)
+	a := args(c, 1, "<s3path>")
+
+	sync := newSync(c)
+	sync.DryRun = c.Bool("dry-run")
+	sync.MaxChanges = c.Int("max-changes")
+	sync.MaxChangesPercent = c.Float64("max-changes-percent")
+	sync.Force = c.Bool("force")
+	if err := sync.Remove(a[0], c.Int("workers")); err != nil {
+		log.Fatal(err)
+	}
+}
+
+var (
+	eventLogOnce sync.Once
+	eventLogFile io.Writer
+)
+
+// eventLog opens the --output-file once, so concurrent jobs share it.
+func eventLog(c *cli.Context) io.Writer {
+	eventLogOnce.Do(func() {
+		eventLogFile = os.Stdout
+		if path := c.String("output-file"); path != "-" {
+			f, err := os.Create(path)
+			if err != nil {
+				log.Fatal(err)
+			}
+			eventLogFile = f
+		}
+	})
+	return eventLogFile
+}
+
+var (
+	metricsOnce sync.Once
+	metricsSrv  *s3sync.Metrics
+)
+
+// metrics starts the --metrics-addr server once, so concurrent jobs share it.
+func metrics(c *cli.Context) *s3sync.Metrics {
+	metricsOnce.Do(func() {
+		addr := c.String("metrics-addr")
+		if addr == "" {
+			return
 		}
-		sync.ExcludePatterns = excludes
-		sync.CopySymlinks = copySymlinks
-		err = sync.Sync(source, target, workers)
+		metricsSrv = s3sync.NewMetrics()
+		go func() {
+			log.Fatal(http.ListenAndServe(addr, metricsSrv))
+		}()
+	})
+	return metricsSrv
+}
+
+// newSync builds an S3Sync from the command line flags.
+func newSync(c *cli.Context) *s3sync.S3Sync {
+	return newWorkersSync(c, c.Int("workers"))
+}
+
+// newWorkersSync builds an S3Sync from the command line flags, with
+// connections for workers workers.
+func newWorkersSync(c *cli.Context, workers int) *s3sync.S3Sync {
+	awsConfig := &aws.Config{
+		MaxRetries: aws.Int(5),
+		LogLevel:   aws.LogLevel(aws.LogLevelType((c.Int("loglevel")))),
+	}
+	endpoint := &s3sync.Endpoint{
+		URL:            c.String("endpoint-url"),
+		Region:         c.String("region"),
+		ForcePathStyle: c.Bool("force-path-style"),
+		NoVerifySSL:    c.Bool("no-verify-ssl"),
+		CABundle:       c.String("ca-bundle"),
+		Connections:    workers,
+	}
+	if err := endpoint.Apply(awsConfig); err != nil {
+		log.Fatal(err)
+	}
+
+	sync := s3sync.New(awsConfig)
+	switch c.String("output") {
+	case "text":
+	case "json":
+		sync.SetEventLog(eventLog(c))
+		// Keep dry run lines out of the JSON on stdout.
+		if c.String("output-file") == "-" {
+			s3sync.ReportOutput = os.Stderr
+		}
+	default:
+		log.Fatalf("--output must be text or json, not %q", c.String("output"))
+	}
+	sync.Metrics = metrics(c)
+	if c.String("profile") != "" || c.String("credentials-file") != "" {
+		sync.CredentialsProvider = &credentials.SharedCredentialsProvider{
+			Filename: c.String("credentials-file"),
+			Profile:  c.String("profile"),
+		}
+	}
+
+	for _, d := range c.StringSlice("exclude-dir") {
+		sync.ExcludeDirectories[d] = true
+	}
+	sync.ExcludePatterns = c.StringSlice("exclude")
+	sync.CopySymlinks = c.Bool("copy-symlinks")
+	sync.UpdateMetadata = c.Bool("update-metadata")
+	sync.VerifyUploads = c.Bool("verify")
+	sync.UnstableRetries = c.Int("unstable-retries")
+	sync.SnapshotSize = int64(c.Int("snapshot-size"))
+	sync.Manifest = c.String("manifest")
+	sync.Delete = c.Bool("delete")
+	sync.MaxChanges = c.Int("max-changes")
+	sync.MaxChangesPercent = c.Float64("max-changes-percent")
+	sync.Force = c.Bool("force")
+	for _, phase := range c.StringSlice("phase") {
+		sync.Phases = append(sync.Phases, s3sync.ParsePhase(phase))
+	}
+	var err error
+	if rulesFile := c.String("rules"); rulesFile != "" {
+		sync.Rules, err = s3sync.LoadRules(rulesFile)
+		if err != nil {
+			log.Fatal(err)
+		}
+	}
+	sync.SniffContentType = c.Bool("sniff-content-type")
+	sync.CharsetUTF8 = c.Bool("charset-utf8")
+	if patterns := c.StringSlice("gzip-pattern"); len(patterns) > 0 {
+		sync.CompressPatterns = patterns
+	} else if c.Bool("gzip") {
+		sync.CompressPatterns = s3sync.DefaultCompressPatterns
+	}
+	if c.IsSet("compression") {
+		sync.Compression = c.String("compression")
+	}
+	sync.SSE.Algorithm = c.String("sse")
+	sync.SSE.KMSKeyID = c.String("sse-kms-key-id")
+	if keyFile := c.String("sse-c-key-file"); keyFile != "" {
+		sync.SSE.CustomerKey, err = s3sync.LoadKey(keyFile)
+		if err != nil {
+			log.Fatal(err)
+		}
+	}
+	if keyFile := c.String("encryption-key-file"); keyFile != "" {
+		key, err := s3sync.LoadKey(keyFile)
 		if err != nil {
 			log.Fatal(err)
 		}
+		sync.Encryption = &s3sync.ClientEncryption{MasterKey: key}
 	}
+	sync.StorageClass = c.String("storage-class")
+	sync.ACL = c.String("acl")
+	for _, tag := range c.StringSlice("tag") {
+		k, v, err := s3sync.ParseTag(tag)
+		if err != nil {
+			log.Fatal(err)
+		}
+		sync.Tags[k] = v
+	}
+	return sync
+}
 
-	app.Run(os.Args)
+// jobSync builds an S3Sync for a configured job. Flags given on the command
+// line take precedence over the job's options.
+func jobSync(c *cli.Context, job *s3sync.Job, workers int) *s3sync.S3Sync {
+	sync := newWorkersSync(c, workers)
+	retrySettings(c, sync)
+	if !c.IsSet("copy-symlinks") && job.CopySymlinks != nil {
+		sync.CopySymlinks = *job.CopySymlinks
+	}
+	if !c.IsSet("exclude") && job.Exclude != nil {
+		sync.ExcludePatterns = job.Exclude
+	}
+	if !c.IsSet("exclude-dir") {
+		for _, d := range job.ExcludeDirs {
+			sync.ExcludeDirectories[d] = true
+		}
+	}
+	if !c.IsSet("rules") && job.Rules != nil {
+		sync.Rules = job.Rules
+	}
+	if !c.IsSet("phase") && job.Phases != nil {
+		sync.Phases = job.Phases
+	}
+	if !c.IsSet("storage-class") && job.StorageClass != "" {
+		sync.StorageClass = job.StorageClass
+	}
+	if !c.IsSet("acl") && job.ACL != "" {
+		sync.ACL = job.ACL
+	}
+	if !c.IsSet("tag") {
+		for k, v := range job.Tags {
+			sync.Tags[k] = v
+		}
+	}
+	return sync
+}
+
+// runConfig runs the jobs in configFile, in order or concurrently, and exits
+// non-zero if any of them failed.
+func runConfig(c *cli.Context, configFile string) {
+	// Both name files relative to a single source.
+	for _, name := range []string{"failed-list", "files-from"} {
+		if c.IsSet(name) {
+			log.Fatalf("--%s can not be used with --config", name)
+		}
+	}
+	if c.Bool("watch") {
+		log.Println("--watch is ignored with --config")
+	}
+
+	config, err := s3sync.LoadConfig(configFile)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	failed := false
+	var mu sync.Mutex
+	run := func(job *s3sync.Job) {
+		workers := job.Workers
+		if workers == 0 || c.IsSet("workers") {
+			workers = c.Int("workers")
+		}
+
+		log.Printf("JOB: %s %s %s", job.Name, job.Source, job.Target)
+		sync := jobSync(c, job, workers)
+		// Each job has its own error counts, so one job aborting on
+		// --max-errors, --max-error-rate or a fatal error leaves the others.
+		if err := sync.Sync(job.Source, job.Target, workers); err != nil {
+			log.Printf("JOB FAILED: %s: %s", job.Name, err)
+			mu.Lock()
+			failed = true
+			mu.Unlock()
+			return
+		}
+		sum := sync.Summary()
+		log.Printf("JOB DONE: %s: %d completed, %d failed", job.Name, sum.Completed, sum.Failed)
+	}
+
+	wg := new(sync.WaitGroup)
+	for i := range config.Jobs {
+		if !config.Concurrent {
+			run(&config.Jobs[i])
+			continue
+		}
+		wg.Add(1)
+		go func(job *s3sync.Job) {
+			defer wg.Done()
+			run(job)
+		}(&config.Jobs[i])
+	}
+	wg.Wait()
+
+	if failed {
+		os.Exit(1)
+	}
 }
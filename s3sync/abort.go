@@ -0,0 +1,70 @@
+package s3sync
+
+import (
+	"fmt"
+	"log"
+)
+
+// errorRateMinimum is how many files must have finished before MaxErrorRate
+// is applied, so the first failure does not count as 100%.
+const errorRateMinimum = 20
+
+// fatalErrors are error codes that will fail every other request too.
+var fatalErrors = map[string]bool{
+	"AccessDenied":          true,
+	"AllAccessDisabled":     true,
+	"ExpiredToken":          true,
+	"Forbidden":             true,
+	"InvalidAccessKeyId":    true,
+	"InvalidBucketName":     true,
+	"NoSuchBucket":          true,
+	"SignatureDoesNotMatch": true,
+}
+
+// abortChan is closed when the sync is aborted.
+func (s *S3Sync) abortChan() chan struct{} {
+	s.abortInit.Do(func() {
+		s.abortCh = make(chan struct{})
+	})
+	return s.abortCh
+}
+
+// abort stops the sync with err. Only the first error is kept.
+func (s *S3Sync) abort(err error) {
+	s.abortOnce.Do(func() {
+		log.Println("ABORT:", err)
+		s.abortErr = err
+		close(s.abortChan())
+	})
+}
+
+// aborted returns the error the sync was aborted with, if any.
+func (s *S3Sync) aborted() error {
+	select {
+	case <-s.abortChan():
+		return s.abortErr
+	default:
+		return nil
+	}
+}
+
+// checkErrors aborts the sync if err is fatal or the failures so far exceed
+// MaxErrors or MaxErrorRate.
+func (s *S3Sync) checkErrors(err error) {
+	if class := errorClass(err); fatalErrors[class] {
+		s.abort(fmt.Errorf("aborted on %s: %v", class, err))
+		return
+	}
+
+	sum := s.Summary()
+	if s.MaxErrors > 0 && sum.Failed >= int64(s.MaxErrors) {
+		s.abort(fmt.Errorf("aborted after %d errors", sum.Failed))
+		return
+	}
+	finished := sum.Completed + sum.Failed
+	if s.MaxErrorRate > 0 && finished >= errorRateMinimum {
+		if rate := float64(sum.Failed) / float64(finished); rate > s.MaxErrorRate {
+			s.abort(fmt.Errorf("aborted after %d of %d files failed", sum.Failed, finished))
+		}
+	}
+}
@@ -0,0 +1,37 @@
+package s3sync
+
+import (
+	"errors"
+	"testing"
+
+	"github.com/aws/aws-sdk-go/aws/awserr"
+)
+
+func TestCheckErrors(t *testing.T) {
+	failure := errors.New("connection reset")
+	tests := []struct {
+		name              string
+		maxErrors         int
+		maxErrorRate      float64
+		completed, failed int64
+		err               error
+		abort             bool
+	}{
+		{"no limits", 0, 0, 0, 100, failure, false},
+		{"fatal error", 0, 0, 10, 1, awserr.New("AccessDenied", "", nil), true},
+		{"fatal HEAD error", 0, 0, 10, 1, awserr.NewRequestFailure(awserr.New("Forbidden", "", nil), 403, ""), true},
+		{"below max errors", 5, 0, 0, 4, failure, false},
+		{"at max errors", 5, 0, 0, 5, failure, true},
+		{"rate before the minimum", 0, 0.1, 9, 10, failure, false},
+		{"rate at the limit", 0, 0.25, 15, 5, failure, false},
+		{"rate over the limit", 0, 0.25, 14, 6, failure, true},
+	}
+	for _, tt := range tests {
+		s := &S3Sync{MaxErrors: tt.maxErrors, MaxErrorRate: tt.maxErrorRate}
+		s.summary.Completed, s.summary.Failed = tt.completed, tt.failed
+		s.checkErrors(tt.err)
+		if got := s.aborted() != nil; got != tt.abort {
+			t.Errorf("%s: aborted = %v, want %v", tt.name, got, tt.abort)
+		}
+	}
+}
@@ -0,0 +1,265 @@
+package s3sync
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/s3"
+)
+
+// Content addressed trees are stored as blobs named after their sha256
+// below blobsDir of the target, and manifests mapping paths to blobs below
+// manifestsDir.
+const (
+	casVersion   = 1
+	blobsDir     = "blobs/"
+	manifestsDir = "manifests/"
+)
+
+// A CASManifest lists the files of a tree stored as content addressed
+// blobs.
+type CASManifest struct {
+	Version int       `json:"version"`
+	Name    string    `json:"name"`
+	Created time.Time `json:"created"`
+	Source  string    `json:"source"`
+	Files   []CASFile `json:"files"`
+}
+
+// A CASFile is a file of a CASManifest, stored in the blob named SHA256.
+type CASFile struct {
+	Path     string            `json:"path"`
+	SHA256   string            `json:"sha256"`
+	Size     int64             `json:"size"`
+	Metadata map[string]string `json:"metadata,omitempty"`
+}
+
+type byCASPath []CASFile
+
+func (b byCASPath) Len() int           { return len(b) }
+func (b byCASPath) Swap(i, j int)      { b[i], b[j] = b[j], b[i] }
+func (b byCASPath) Less(i, j int) bool { return b[i].Path < b[j].Path }
+
+// PutCAS uploads source below target as content addressed blobs and writes
+// a manifest called name. Blobs that already exist are not uploaded again,
+// and files with the same content are uploaded once. The manifest is only
+// written if every blob was.
+func (s *S3Sync) PutCAS(source, target, name string, workers int) (*CASManifest, error) {
+	if !isLocalPath(source) || !isS3Path(target) {
+		return nil, errors.New("Content addressed trees can only be uploaded from a local directory to S3")
+	}
+	if err := validID(name); err != nil {
+		return nil, err
+	}
+	if s.Encryption != nil {
+		// Blob names would reveal the content of encrypted files.
+		return nil, errors.New("Content addressed trees cannot be encrypted client side")
+	}
+	if err := s.SSE.Validate(); err != nil {
+		return nil, err
+	}
+	abs, err := filepath.Abs(source)
+	if err != nil {
+		return nil, err
+	}
+	s3url, err := parseS3Path(target)
+	if err != nil {
+		return nil, err
+	}
+	bucket, base := s3url.Host, cleanS3Path(s3url.Path)
+
+	s3Svc, err := s.client()
+	if err != nil {
+		return nil, err
+	}
+	blobs, err := s.bucketIndex(bucket, base+blobsDir)
+	if err != nil {
+		return nil, err
+	}
+	defer s.emitSummary()
+
+	failed := s.Summary().Failed
+	var files []*localToS3Input
+	s.walkFiles(source, source, func(path, relPath string, info os.FileInfo) {
+		in, err := s.newLocalToS3Input(path, relPath, bucket, "", info)
+		if err != nil {
+			log.Println(err)
+			s.emitFailed("hash", "", path, err)
+			return
+		}
+		// Blobs are shared by files of any mode and owner.
+		in.Params.Metadata = make(map[string]*string)
+		files = append(files, in)
+	})
+	s.hashFiles(files, workers)
+
+	queued := make(map[string]bool)
+	q := s.startUploaders(s3Svc, workers)
+	for _, in := range files {
+		if in.BlobSHA256 == "" {
+			continue
+		}
+		key := base + blobsDir + in.BlobSHA256
+		in.Params.Key = aws.String(key)
+		if blobs.Exists(key) || queued[key] {
+			s.emit(Event{Event: EventSkipped, Key: key, Path: in.LocalPath, Reason: "blob"})
+			continue
+		}
+		queued[key] = true
+		s.emit(Event{Event: EventPlanned, Key: key, Path: in.LocalPath, Bytes: in.size()})
+		q.add(in)
+	}
+	q.wait()
+
+	if s.FailedList != "" {
+		if err := s.writeFailedList(); err != nil {
+			return nil, err
+		}
+	}
+	if err := s.aborted(); err != nil {
+		return nil, err
+	}
+	if n := s.Summary().Failed - failed; n > 0 {
+		return nil, fmt.Errorf("manifest %s not written, %d files failed", name, n)
+	}
+
+	key := base + manifestsDir + name + ".json"
+	m := &CASManifest{Version: casVersion, Name: name, Created: time.Now().UTC(), Source: abs}
+	for _, in := range files {
+		m.Files = append(m.Files, CASFile{
+			Path:     filepath.ToSlash(in.RelPath),
+			SHA256:   in.BlobSHA256,
+			Size:     in.Info.Size(),
+			Metadata: stringMetadata(in.Info),
+		})
+	}
+	sort.Sort(byCASPath(m.Files))
+	if s.DryRun {
+		report("manifest", key)
+		return m, nil
+	}
+	return m, s.putJSON(s3Svc, bucket, key, m)
+}
+
+// hashFiles sets the BlobSHA256 of files, hashing workers files at a time.
+func (s *S3Sync) hashFiles(files []*localToS3Input, workers int) {
+	ch := make(chan *localToS3Input)
+	wg := new(sync.WaitGroup)
+	wg.Add(workers)
+	for i := 0; i < workers; i++ {
+		go func() {
+			defer wg.Done()
+			for in := range ch {
+				sum, err := fileSHA256(in)
+				if err != nil {
+					log.Println(err)
+					s.emitFailed("hash", "", in.LocalPath, err)
+					continue
+				}
+				in.BlobSHA256 = sum
+			}
+		}()
+	}
+	for _, in := range files {
+		if s.aborted() != nil {
+			break
+		}
+		ch <- in
+	}
+	close(ch)
+	wg.Wait()
+}
+
+// GetCAS downloads the tree of manifest name below target to dest. Files in
+// dest with the same size, mode and sha256 are left alone.
+func (s *S3Sync) GetCAS(target, name, dest string, workers int) error {
+	if err := validID(name); err != nil {
+		return err
+	}
+	if err := s.SSE.Validate(); err != nil {
+		return err
+	}
+	s3url, err := parseS3Path(target)
+	if err != nil {
+		return err
+	}
+	bucket, base := s3url.Host, cleanS3Path(s3url.Path)
+
+	s3Svc, err := s.client()
+	if err != nil {
+		return err
+	}
+	m, err := s.loadCASManifest(s3Svc, bucket, base+manifestsDir+name+".json")
+	if err != nil {
+		return err
+	}
+	defer s.emitSummary()
+
+	failed := s.Summary().Failed
+	keyChan, wg := s.startDownloaders(s3Svc, workers)
+	for _, f := range m.Files {
+		if s.aborted() != nil {
+			break
+		}
+		key := base + blobsDir + f.SHA256
+		path, err := localPath(dest, f.Path)
+		if err != nil {
+			log.Println(err)
+			s.emitFailed("download", key, "", err)
+			continue
+		}
+		mode, _ := strconv.ParseUint(f.Metadata["mode"], 10, 32)
+		s.emit(Event{Event: EventPlanned, Key: key, Path: path, Bytes: f.Size})
+		keyChan <- &s3ToLocalInput{
+			LocalPath: path,
+			Root:      dest,
+			Params:    s.getParams(bucket, key),
+			Mode:      mode,
+			SHA256:    f.SHA256,
+			Size:      f.Size,
+		}
+	}
+	close(keyChan)
+	wg.Wait()
+
+	if err := s.aborted(); err != nil {
+		return err
+	}
+	if n := s.Summary().Failed - failed; n > 0 {
+		return fmt.Errorf("%d files of %s could not be downloaded", n, name)
+	}
+	return nil
+}
+
+// materialized reports whether the local file of in already has its size,
+// mode and sha256.
+func (in *s3ToLocalInput) materialized() bool {
+	info, err := os.Lstat(in.LocalPath)
+	if err != nil || info.Size() != in.Size || !info.Mode().IsRegular() {
+		return false
+	}
+	if m := stringMetadata(info)["mode"]; in.Mode != 0 && m != strconv.FormatUint(in.Mode, 10) {
+		return false
+	}
+	sum, err := fileSHA256(&localToS3Input{LocalPath: in.LocalPath, Info: info})
+	return err == nil && sum == in.SHA256
+}
+
+func (s *S3Sync) loadCASManifest(s3Svc *s3.S3, bucket, key string) (*CASManifest, error) {
+	m := new(CASManifest)
+	if err := s.getJSON(s3Svc, bucket, key, m); err != nil {
+		return nil, err
+	}
+	if m.Version != casVersion {
+		return nil, fmt.Errorf("%s: unsupported manifest version %d", key, m.Version)
+	}
+	return m, nil
+}
@@ -0,0 +1,168 @@
+package s3sync
+
+import (
+	"bytes"
+	"crypto/md5"
+	"crypto/sha256"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/s3"
+)
+
+// metaSHA256 is the metadata holding the hex sha256 of the original file.
+const metaSHA256 = "sha256"
+
+// Manifest formats.
+const (
+	ManifestSHA256SUMS = "sha256sums"
+	ManifestJSON       = "json"
+)
+
+// manifestName returns the name of the manifest object for format.
+func manifestName(format string) (string, error) {
+	switch format {
+	case ManifestSHA256SUMS:
+		return "SHA256SUMS", nil
+	case ManifestJSON:
+		return "manifest.json", nil
+	}
+	return "", fmt.Errorf("unknown manifest format %q, expected %s or %s", format, ManifestSHA256SUMS, ManifestJSON)
+}
+
+// sumFile returns the md5, sha256 and length of file and rewinds it.
+func sumFile(file io.ReadSeeker) ([]byte, []byte, int64, error) {
+	m := md5.New()
+	h := sha256.New()
+	n, err := io.Copy(io.MultiWriter(m, h), file)
+	if err != nil {
+		return nil, nil, 0, err
+	}
+	if _, err := file.Seek(0, 0); err != nil {
+		return nil, nil, 0, err
+	}
+	return m.Sum(nil), h.Sum(nil), n, nil
+}
+
+func sha256Hex(src io.Reader) string {
+	h := sha256.New()
+	io.Copy(h, src)
+	return fmt.Sprintf("%x", h.Sum(nil))
+}
+
+// fileSHA256 returns the sha256 of what was or would be uploaded for in.
+func fileSHA256(in *localToS3Input) (string, error) {
+	if in.SHA256 != "" {
+		return in.SHA256, nil
+	}
+	if in.Info.Mode()&os.ModeSymlink != 0 {
+		return sha256Hex(strings.NewReader(in.SymlinkTarget)), nil
+	}
+
+	file, err := os.Open(in.LocalPath)
+	if err != nil {
+		return "", err
+	}
+	defer file.Close()
+
+	h := sha256.New()
+	if _, err := io.Copy(h, file); err != nil {
+		return "", err
+	}
+	return fmt.Sprintf("%x", h.Sum(nil)), nil
+}
+
+type manifestEntry struct {
+	Path   string `json:"path"`
+	Key    string `json:"key"`
+	Size   int64  `json:"size"`
+	SHA256 string `json:"sha256,omitempty"`
+}
+
+// writeManifest uploads a manifest of every synced file to prefix. A nil
+// entry in files is a file that could not be read.
+func (s *S3Sync) writeManifest(s3Svc *s3.S3, bucket, prefix string, files map[string]*localToS3Input) error {
+	name, err := manifestName(s.Manifest)
+	if err != nil {
+		return err
+	}
+	key := prefix + name
+	if s.DryRun {
+		report("manifest", key)
+		return nil
+	}
+
+	var keys []string
+	for k := range files {
+		if k != key {
+			keys = append(keys, k)
+		}
+	}
+	sort.Strings(keys)
+
+	entries := make([]manifestEntry, 0, len(keys))
+	for _, k := range keys {
+		in := files[k]
+		if in == nil {
+			return fmt.Errorf("manifest not written, %s could not be read", k)
+		}
+		sum, err := fileSHA256(in)
+		if err != nil {
+			return err
+		}
+		entries = append(entries, manifestEntry{
+			Path:   strings.TrimPrefix(k, prefix),
+			Key:    k,
+			Size:   in.Info.Size(),
+			SHA256: sum,
+		})
+	}
+
+	body := new(bytes.Buffer)
+	contentType := "text/plain; charset=utf-8"
+	if s.Manifest == ManifestJSON {
+		contentType = "application/json"
+		enc := json.NewEncoder(body)
+		if err := enc.Encode(map[string][]manifestEntry{"files": entries}); err != nil {
+			return err
+		}
+	} else {
+		for _, e := range entries {
+			fmt.Fprintf(body, "%s  %s\n", e.SHA256, e.Path)
+		}
+	}
+
+	params := &s3.PutObjectInput{
+		Bucket:      aws.String(bucket),
+		Key:         aws.String(key),
+		ContentType: aws.String(contentType),
+		Body:        bytes.NewReader(body.Bytes()),
+	}
+	s.SSE.applyPut(params)
+
+	start := time.Now()
+	log.Println("MANIFEST:", key)
+	s.emit(Event{Event: EventStarted, Action: "manifest", Key: key})
+	sum := md5.Sum(body.Bytes())
+	out, err := putObject(s3Svc, params, nil, sum[:], nil)
+	if err != nil {
+		s.emitFailed("manifest", key, "", err)
+		return err
+	}
+	s.emit(Event{
+		Event:    EventCompleted,
+		Action:   "manifest",
+		Key:      key,
+		Bytes:    int64(body.Len()),
+		Duration: time.Since(start).Seconds(),
+		ETag:     aws.StringValue(out.ETag),
+	})
+	return nil
+}
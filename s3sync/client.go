@@ -0,0 +1,35 @@
+package s3sync
+
+import (
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/credentials"
+	"github.com/aws/aws-sdk-go/service/s3"
+)
+
+// client returns the S3 client shared by all workers. Credentials are
+// resolved on first use, so a bad profile fails the sync before any work
+// starts.
+func (s *S3Sync) client() (*s3.S3, error) {
+	s.clientOnce.Do(func() {
+		config := s.AWSConfig
+		if config == nil {
+			config = aws.NewConfig()
+		}
+		if s.CredentialsProvider != nil {
+			config = config.Merge(&aws.Config{
+				Credentials: credentials.NewCredentials(s.CredentialsProvider),
+			})
+		}
+
+		s3Svc := s3.New(config)
+		if s.Metrics != nil {
+			s.Metrics.instrument(s3Svc)
+		}
+		if _, err := s3Svc.Config.Credentials.Get(); err != nil {
+			s.clientErr = err
+			return
+		}
+		s.s3Svc = s3Svc
+	})
+	return s.s3Svc, s.clientErr
+}
@@ -0,0 +1,225 @@
+package s3sync
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/s3"
+)
+
+// List returns the objects under an s3://bucket/path, which may also name a
+// single key.
+func (s *S3Sync) List(target string) (string, []*s3.Object, error) {
+	s3url, err := parseS3Path(target)
+	if err != nil {
+		return "", nil, err
+	}
+
+	prefix := strings.TrimPrefix(s3url.Path, "/")
+	bucketIndex, err := s.bucketIndex(s3url.Host, prefix)
+	if err != nil {
+		return "", nil, err
+	}
+
+	dir := cleanS3Path(prefix)
+	objects := make([]*s3.Object, 0, len(bucketIndex))
+	for key, o := range bucketIndex {
+		if key == prefix || strings.HasPrefix(key, dir) {
+			objects = append(objects, o)
+		}
+	}
+	sort.Sort(byKey(objects))
+	return s3url.Host, objects, nil
+}
+
+type byKey []*s3.Object
+
+func (b byKey) Len() int           { return len(b) }
+func (b byKey) Swap(i, j int)      { b[i], b[j] = b[j], b[i] }
+func (b byKey) Less(i, j int) bool { return *b[i].Key < *b[j].Key }
+
+// Remove deletes every object under an s3://bucket/path, in batches spread
+// over workers. Emptying a whole bucket needs Force, and MaxChanges and
+// MaxChangesPercent are checked against the objects under the path.
+func (s *S3Sync) Remove(target string, workers int) error {
+	s3Svc, err := s.client()
+	if err != nil {
+		return err
+	}
+
+	s3url, err := parseS3Path(target)
+	if err != nil {
+		return err
+	}
+	if strings.Trim(s3url.Path, "/") == "" && !s.Force && !s.DryRun {
+		return fmt.Errorf("refusing to delete every object in bucket %s, use --force to delete them", s3url.Host)
+	}
+	bucket, objects, err := s.List(target)
+	if err != nil {
+		return err
+	}
+	if s.guarded() {
+		if err := s.checkPlan(len(objects), nil, len(objects)); err != nil {
+			return err
+		}
+	}
+	defer s.emitSummary()
+
+	batchChan := make(chan []*s3.ObjectIdentifier, workers)
+	wg := new(sync.WaitGroup)
+	wg.Add(workers)
+	for i := 0; i < workers; i++ {
+		go func() {
+			defer wg.Done()
+			for batch := range batchChan {
+				if s.aborted() != nil {
+					continue
+				}
+				s.busy(1)
+				s.deleteObjects(s3Svc, bucket, batch)
+				s.busy(-1)
+			}
+		}()
+	}
+
+	batch := make([]*s3.ObjectIdentifier, 0, 1000)
+	for _, o := range objects {
+		if s.aborted() != nil {
+			break
+		}
+		batch = append(batch, &s3.ObjectIdentifier{Key: o.Key})
+		if len(batch) == cap(batch) {
+			batchChan <- batch
+			batch = make([]*s3.ObjectIdentifier, 0, 1000)
+		}
+	}
+	if len(batch) > 0 && s.aborted() == nil {
+		batchChan <- batch
+	}
+	close(batchChan)
+
+	wg.Wait()
+
+	return s.aborted()
+}
+
+func (s *S3Sync) deleteObjects(s3Svc *s3.S3, bucket string, batch []*s3.ObjectIdentifier) {
+	if s.DryRun {
+		for _, o := range batch {
+			report("delete", *o.Key)
+		}
+		return
+	}
+
+	resp, err := s3Svc.DeleteObjects(&s3.DeleteObjectsInput{
+		Bucket: aws.String(bucket),
+		Delete: &s3.Delete{Objects: batch, Quiet: aws.Bool(true)},
+	})
+	if err != nil {
+		log.Print(err)
+		for _, o := range batch {
+			s.emitFailed("delete", *o.Key, "", err)
+		}
+		return
+	}
+
+	failed := make(map[string]bool)
+	for _, e := range resp.Errors {
+		log.Printf("DELETE FAILED: %s: %s", aws.StringValue(e.Key), aws.StringValue(e.Message))
+		failed[aws.StringValue(e.Key)] = true
+		s.emit(Event{
+			Event:      EventFailed,
+			Action:     "delete",
+			Key:        aws.StringValue(e.Key),
+			Error:      aws.StringValue(e.Message),
+			ErrorClass: aws.StringValue(e.Code),
+		})
+	}
+	for _, o := range batch {
+		if !failed[*o.Key] {
+			s.emit(Event{Event: EventDeleted, Key: *o.Key})
+		}
+	}
+	log.Printf("DELETED: %d objects", len(batch)-len(resp.Errors))
+}
+
+// Copy copies a single file or key. A target ending in / names a directory
+// or prefix to copy into.
+func (s *S3Sync) Copy(source, target string) error {
+	if err := s.SSE.Validate(); err != nil {
+		return err
+	}
+	s3Svc, err := s.client()
+	if err != nil {
+		return err
+	}
+
+	switch {
+	case isLocalPath(source) && isS3Path(target):
+		dst, err := parseS3Path(target)
+		if err != nil {
+			return err
+		}
+		info, err := os.Lstat(source)
+		if err != nil {
+			return err
+		}
+		if info.IsDir() {
+			return errors.New(source + " is a directory, use sync")
+		}
+		key := strings.TrimPrefix(dst.Path, "/")
+		if strings.HasSuffix(key, "/") {
+			key += filepath.Base(source)
+		}
+		in, err := s.newLocalToS3Input(source, filepath.Base(source), dst.Host, key, info)
+		if err != nil {
+			return err
+		}
+		_, err = s.uploadStable(s3Svc, in)
+		return err
+
+	case isS3Path(source) && !isS3Path(target):
+		src, err := parseS3Path(source)
+		if err != nil {
+			return err
+		}
+		key := strings.TrimPrefix(src.Path, "/")
+		if info, err := os.Stat(target); (err == nil && info.IsDir()) || strings.HasSuffix(target, "/") {
+			target = filepath.Join(target, path.Base(key))
+		}
+		_, err = s.s3ToLocal(s3Svc, &s3ToLocalInput{LocalPath: target, Params: s.getParams(src.Host, key)})
+		return err
+
+	case isS3Path(source) && isS3Path(target):
+		src, err := parseS3Path(source)
+		if err != nil {
+			return err
+		}
+		dst, err := parseS3Path(target)
+		if err != nil {
+			return err
+		}
+		srcKey := strings.TrimPrefix(src.Path, "/")
+		dstKey := strings.TrimPrefix(dst.Path, "/")
+		if strings.HasSuffix(dstKey, "/") {
+			dstKey += path.Base(srcKey)
+		}
+		params := &s3.PutObjectInput{Bucket: aws.String(dst.Host), Key: aws.String(dstKey)}
+		s.SSE.applyPut(params)
+		copyInput := copyParams(params)
+		copyInput.CopySource = aws.String(copySource(src.Host, srcKey))
+		copyInput.MetadataDirective = aws.String(s3.MetadataDirectiveCopy)
+		_, err = s3Svc.CopyObject(copyInput)
+		return err
+	}
+
+	return errors.New("Operation not supported")
+}
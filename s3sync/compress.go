@@ -0,0 +1,171 @@
+package s3sync
+
+import (
+	"compress/gzip"
+	"crypto/hmac"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"strconv"
+
+	"github.com/andybalholm/brotli"
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/s3"
+)
+
+// Metadata recording the size and md5 of a file before it was compressed, so
+// an unchanged file can be detected even though the object size differs.
+const (
+	metaOriginalSize = "original-size"
+	metaOriginalMD5  = "original-md5"
+)
+
+// Content encodings files matching CompressPatterns can be compressed with.
+const (
+	CompressionGzip   = "gzip"
+	CompressionBrotli = "br"
+)
+
+var DefaultCompressPatterns = []string{"*.js", "*.css", "*.html", "*.svg"}
+
+func (s *S3Sync) compressFile(relPath string) bool {
+	for _, pattern := range s.CompressPatterns {
+		if matchPattern(pattern, relPath) {
+			return true
+		}
+	}
+	return false
+}
+
+// compressBody compresses file, whose md5 is sum, with the content encoding
+// in.Compress into a temporary spool and makes that the body of in, unless
+// compressing does not make it smaller, in which case file is sent as is.
+// The caller removes the returned spool, if any, once the body was sent.
+func compressBody(in *localToS3Input, file io.ReadSeeker, sum []byte) (*os.File, error) {
+	spool, err := ioutil.TempFile("", "s3sync")
+	if err != nil {
+		return nil, err
+	}
+	if err := compress(spool, file, in.Compress); err != nil {
+		removeSpool(spool)
+		return nil, err
+	}
+	size, err := spool.Seek(0, 1)
+	if err != nil {
+		removeSpool(spool)
+		return nil, err
+	}
+
+	if size >= in.Info.Size() {
+		debug("Not compressing:", in.LocalPath)
+		removeSpool(spool)
+		_, err := file.Seek(0, 0)
+		in.Params.Body = file
+		return nil, err
+	}
+	if _, err := spool.Seek(0, 0); err != nil {
+		removeSpool(spool)
+		return nil, err
+	}
+
+	in.Params.Body = spool
+	in.Params.ContentEncoding = aws.String(in.Compress)
+	if in.Params.Metadata == nil {
+		in.Params.Metadata = make(map[string]*string)
+	}
+	in.Params.Metadata[metaOriginalSize] = aws.String(fmt.Sprint(in.Info.Size()))
+	in.Params.Metadata[metaOriginalMD5] = aws.String(fmt.Sprintf("%x", sum))
+	return spool, nil
+}
+
+// compress writes r to w compressed with encoding.
+func compress(w io.Writer, r io.Reader, encoding string) error {
+	var zw io.WriteCloser
+	switch encoding {
+	case CompressionGzip:
+		zw = gzip.NewWriter(w)
+	case CompressionBrotli:
+		zw = brotli.NewWriter(w)
+	default:
+		return validCompression(encoding)
+	}
+	if _, err := io.Copy(zw, r); err != nil {
+		zw.Close()
+		return err
+	}
+	return zw.Close()
+}
+
+// decompress writes r, which was compressed with encoding, to w.
+func decompress(w io.Writer, r io.Reader, encoding string) error {
+	switch encoding {
+	case CompressionGzip:
+		zr, err := gzip.NewReader(r)
+		if err != nil {
+			return err
+		}
+		defer zr.Close()
+		r = zr
+	case CompressionBrotli:
+		r = brotli.NewReader(r)
+	default:
+		return validCompression(encoding)
+	}
+	_, err := io.Copy(w, r)
+	return err
+}
+
+func validCompression(encoding string) error {
+	switch encoding {
+	case CompressionGzip, CompressionBrotli:
+		return nil
+	}
+	return fmt.Errorf("unsupported compression %q, expected %s or %s", encoding, CompressionGzip, CompressionBrotli)
+}
+
+func removeSpool(spool *os.File) {
+	spool.Close()
+	os.Remove(spool.Name())
+}
+
+// originalMatches reports whether metadata describes a compressed or
+// encrypted copy of the current contents of the local file at path. Objects
+// encrypted client side are compared by their keyed hmac, which needs e.
+func originalMatches(path string, size int64, metadata map[string]*string, e *ClientEncryption) (bool, error) {
+	original := metadataValue(metadata, metaOriginalSize)
+	if original == "" || original != strconv.FormatInt(size, 10) {
+		return false, nil
+	}
+	if metadataValue(metadata, metaCSEAlgorithm) != "" {
+		remote := metadataValue(metadata, metaOriginalMAC)
+		if e == nil || remote == "" {
+			return false, nil
+		}
+		mac, err := e.macFile(path)
+		if err != nil {
+			return false, err
+		}
+		return hmac.Equal([]byte(mac), []byte(remote)), nil
+	}
+
+	sum, err := md5File(path)
+	if err != nil {
+		return false, err
+	}
+	return metadataValue(metadata, metaOriginalMD5) == sum, nil
+}
+
+// adoptOriginal copies the metadata describing how an up to date object was
+// transformed into params, so it survives an in-place metadata update.
+func adoptOriginal(params *s3.PutObjectInput, head *s3.HeadObjectOutput) {
+	if params.Metadata == nil {
+		params.Metadata = make(map[string]*string)
+	}
+	for _, k := range []string{metaOriginalSize, metaOriginalMD5, metaOriginalMAC, metaCSEAlgorithm, metaCSEKey, metaCSENonce} {
+		if v := metadataValue(head.Metadata, k); v != "" {
+			params.Metadata[k] = aws.String(v)
+		}
+	}
+	params.ContentEncoding = head.ContentEncoding
+}
@@ -0,0 +1,64 @@
+package s3sync
+
+import (
+	"bytes"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/aws/aws-sdk-go/aws"
+)
+
+func TestOriginalMatches(t *testing.T) {
+	dir, err := ioutil.TempDir("", "s3sync")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "a.css")
+	if err := ioutil.WriteFile(path, []byte("body { color: red }\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	sum, err := md5File(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	e := &ClientEncryption{MasterKey: bytes.Repeat([]byte{1}, 32)}
+	other := &ClientEncryption{MasterKey: bytes.Repeat([]byte{2}, 32)}
+	mac, err := e.macFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	meta := func(kv ...string) map[string]*string {
+		m := make(map[string]*string)
+		for i := 0; i < len(kv); i += 2 {
+			m[kv[i]] = aws.String(kv[i+1])
+		}
+		return m
+	}
+	tests := []struct {
+		name     string
+		size     int64
+		metadata map[string]*string
+		e        *ClientEncryption
+		want     bool
+	}{
+		{"compressed copy", 20, meta(metaOriginalSize, "20", metaOriginalMD5, sum), nil, true},
+		{"not compressed", 20, meta(), nil, false},
+		{"size", 21, meta(metaOriginalSize, "20", metaOriginalMD5, sum), nil, false},
+		{"md5", 20, meta(metaOriginalSize, "20", metaOriginalMD5, "0"), nil, false},
+		{"encrypted copy", 20, meta(metaOriginalSize, "20", metaCSEAlgorithm, cseAlgorithm, metaOriginalMAC, mac), e, true},
+		{"encrypted without a key", 20, meta(metaOriginalSize, "20", metaCSEAlgorithm, cseAlgorithm, metaOriginalMAC, mac), nil, false},
+		{"encrypted with another key", 20, meta(metaOriginalSize, "20", metaCSEAlgorithm, cseAlgorithm, metaOriginalMAC, mac), other, false},
+		{"encrypted without a mac", 20, meta(metaOriginalSize, "20", metaCSEAlgorithm, cseAlgorithm), e, false},
+		{"md5 of an encrypted copy", 20, meta(metaOriginalSize, "20", metaCSEAlgorithm, cseAlgorithm, metaOriginalMD5, sum), e, false},
+	}
+	for _, tt := range tests {
+		got, err := originalMatches(path, tt.size, tt.metadata, tt.e)
+		if err != nil || got != tt.want {
+			t.Errorf("%s: originalMatches = %v, %v, want %v", tt.name, got, err, tt.want)
+		}
+	}
+}
@@ -0,0 +1,142 @@
+package s3sync
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+
+	"gopkg.in/yaml.v3"
+)
+
+// Config declares one or more sync jobs. Defaults apply to every job that
+// leaves the corresponding option unset.
+type Config struct {
+	Concurrent bool  `json:"concurrent"`
+	Defaults   Job   `json:"defaults"`
+	Jobs       []Job `json:"jobs"`
+}
+
+// A Job is one sync of a Config. Booleans are pointers so that a job can
+// turn off an option its defaults turn on.
+type Job struct {
+	Name         string            `json:"name"`
+	Source       string            `json:"source"`
+	Target       string            `json:"target"`
+	Workers      int               `json:"workers"`
+	CopySymlinks *bool             `json:"copy_symlinks"`
+	Exclude      []string          `json:"exclude"`
+	ExcludeDirs  []string          `json:"exclude_dirs"`
+	Rules        []Rule            `json:"rules"`
+	Phases       [][]string        `json:"phases"`
+	StorageClass string            `json:"storage_class"`
+	ACL          string            `json:"acl"`
+	Tags         map[string]string `json:"tags"`
+}
+
+// LoadConfig reads a job configuration, in YAML if path ends in .yaml or
+// .yml and in JSON otherwise. $VAR and ${VAR} references are replaced with
+// the value of the environment variable, in JSON before parsing.
+func LoadConfig(path string) (*Config, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	switch filepath.Ext(path) {
+	case ".yaml", ".yml":
+		// YAML is converted to JSON, so both share the field names. The
+		// variables are expanded in the parsed values, as YAML has no single
+		// escaping that is safe in every kind of scalar.
+		var v interface{}
+		if err := yaml.Unmarshal(data, &v); err != nil {
+			return nil, fmt.Errorf("%s: %s", path, err)
+		}
+		if data, err = json.Marshal(expandStrings(v)); err != nil {
+			return nil, fmt.Errorf("%s: %s", path, err)
+		}
+	default:
+		data = []byte(os.Expand(string(data), func(name string) string {
+			// Escape the value so it can not break out of a JSON string.
+			quoted, _ := json.Marshal(os.Getenv(name))
+			return string(quoted[1 : len(quoted)-1])
+		}))
+	}
+
+	config := new(Config)
+	if err := json.Unmarshal(data, config); err != nil {
+		return nil, fmt.Errorf("%s: %s", path, err)
+	}
+
+	for i := range config.Jobs {
+		job := &config.Jobs[i]
+		job.inherit(&config.Defaults)
+		if job.Name == "" {
+			job.Name = fmt.Sprintf("job %d", i)
+		}
+		if job.Source == "" || job.Target == "" {
+			return nil, fmt.Errorf("%s: %s: source and target required", path, job.Name)
+		}
+		for j := range job.Rules {
+			if err := job.Rules[j].validate(); err != nil {
+				return nil, fmt.Errorf("%s: %s: rule %d: %s", path, job.Name, j, err)
+			}
+		}
+	}
+	return config, nil
+}
+
+// expandStrings replaces environment variable references in the strings of a
+// parsed YAML document.
+func expandStrings(v interface{}) interface{} {
+	switch v := v.(type) {
+	case string:
+		return os.ExpandEnv(v)
+	case []interface{}:
+		for i := range v {
+			v[i] = expandStrings(v[i])
+		}
+	case map[string]interface{}:
+		for k := range v {
+			v[k] = expandStrings(v[k])
+		}
+	}
+	return v
+}
+
+func (j *Job) inherit(defaults *Job) {
+	if j.Source == "" {
+		j.Source = defaults.Source
+	}
+	if j.Target == "" {
+		j.Target = defaults.Target
+	}
+	if j.Workers == 0 {
+		j.Workers = defaults.Workers
+	}
+	if j.CopySymlinks == nil {
+		j.CopySymlinks = defaults.CopySymlinks
+	}
+	if j.Exclude == nil {
+		j.Exclude = defaults.Exclude
+	}
+	if j.ExcludeDirs == nil {
+		j.ExcludeDirs = defaults.ExcludeDirs
+	}
+	if j.Rules == nil {
+		j.Rules = defaults.Rules
+	}
+	if j.Phases == nil {
+		j.Phases = defaults.Phases
+	}
+	if j.StorageClass == "" {
+		j.StorageClass = defaults.StorageClass
+	}
+	if j.ACL == "" {
+		j.ACL = defaults.ACL
+	}
+	if j.Tags == nil {
+		j.Tags = defaults.Tags
+	}
+}
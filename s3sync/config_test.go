@@ -0,0 +1,131 @@
+package s3sync
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestJobInherit(t *testing.T) {
+	yes, no := true, false
+	defaults := Job{
+		Source:       "./site",
+		Target:       "s3://bucket/site",
+		Workers:      8,
+		CopySymlinks: &yes,
+		Exclude:      []string{"*.tmp"},
+		ExcludeDirs:  []string{".git"},
+		Rules:        []Rule{{Pattern: "*.html"}},
+		Phases:       [][]string{{"*.html"}},
+		StorageClass: "STANDARD_IA",
+		ACL:          "private",
+		Tags:         map[string]string{"team": "web"},
+	}
+
+	inherited := Job{Name: "a"}
+	inherited.inherit(&defaults)
+	want := defaults
+	want.Name = "a"
+	if !reflect.DeepEqual(inherited, want) {
+		t.Errorf("empty job inherits %+v, want %+v", inherited, want)
+	}
+
+	own := Job{
+		Name:         "b",
+		Source:       "./docs",
+		Target:       "s3://bucket/docs",
+		Workers:      2,
+		CopySymlinks: &no,
+		Exclude:      []string{},
+		ExcludeDirs:  []string{"node_modules"},
+		Rules:        []Rule{},
+		Phases:       [][]string{},
+		StorageClass: "STANDARD",
+		ACL:          "public-read",
+		Tags:         map[string]string{},
+	}
+	want = own
+	own.inherit(&defaults)
+	if !reflect.DeepEqual(own, want) {
+		t.Errorf("job with its own options became %+v, want %+v", own, want)
+	}
+	if *own.CopySymlinks {
+		t.Error("copy_symlinks false was overridden by the defaults")
+	}
+}
+
+func TestLoadConfig(t *testing.T) {
+	dir, err := ioutil.TempDir("", "s3sync")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	os.Setenv("S3SYNC_TEST_BUCKET", `bucket"name`)
+	defer os.Unsetenv("S3SYNC_TEST_BUCKET")
+
+	files := map[string]string{
+		"jobs.json": `{
+  "defaults": {"target": "s3://${S3SYNC_TEST_BUCKET}/site", "copy_symlinks": true, "exclude_dirs": [".git"]},
+  "jobs": [
+    {"source": "./site"},
+    {"name": "docs", "source": "./docs", "copy_symlinks": false,
+     "rules": [{"pattern": "*.html", "headers": {"Cache-Control": "no-cache"}}]}
+  ]
+}`,
+		"jobs.yaml": `defaults:
+  target: s3://${S3SYNC_TEST_BUCKET}/site
+  copy_symlinks: true
+  exclude_dirs: [.git]
+jobs:
+  - source: ./site
+  - name: docs
+    source: ./docs
+    copy_symlinks: false
+    rules:
+      - pattern: "*.html"
+        headers:
+          Cache-Control: no-cache
+`,
+	}
+	for name, content := range files {
+		path := filepath.Join(dir, name)
+		if err := ioutil.WriteFile(path, []byte(content), 0644); err != nil {
+			t.Fatal(err)
+		}
+		config, err := LoadConfig(path)
+		if err != nil {
+			t.Errorf("%s: %v", name, err)
+			continue
+		}
+		if len(config.Jobs) != 2 {
+			t.Errorf("%s: %d jobs, want 2", name, len(config.Jobs))
+			continue
+		}
+		site, docs := config.Jobs[0], config.Jobs[1]
+		if site.Name != "job 0" || site.Target != `s3://bucket"name/site` || !*site.CopySymlinks ||
+			!reflect.DeepEqual(site.ExcludeDirs, []string{".git"}) {
+			t.Errorf("%s: first job is %+v", name, site)
+		}
+		if docs.Name != "docs" || docs.Target != site.Target || *docs.CopySymlinks ||
+			len(docs.Rules) != 1 || docs.Rules[0].Headers["Cache-Control"] != "no-cache" {
+			t.Errorf("%s: second job is %+v", name, docs)
+		}
+	}
+
+	errors := map[string]string{
+		"missing.json": `{"jobs": [{"source": "./site"}]}`,
+		"badrule.yml":  "jobs:\n  - source: ./site\n    target: s3://bucket/site\n    rules: [{pattern: '*', headers: {X-Foo: bar}}]\n",
+	}
+	for name, content := range errors {
+		path := filepath.Join(dir, name)
+		if err := ioutil.WriteFile(path, []byte(content), 0644); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := LoadConfig(path); err == nil || !strings.HasPrefix(err.Error(), path) {
+			t.Errorf("%s: err = %v, want an error naming the file", name, err)
+		}
+	}
+}
@@ -0,0 +1,289 @@
+package s3sync
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash"
+	"io"
+	"os"
+
+	"github.com/aws/aws-sdk-go/aws"
+)
+
+// Client-side encryption splits a file into chunks that are each sealed with
+// AES-GCM under a random per-object data key. The data key is itself sealed
+// with the master key and stored in the object metadata.
+const (
+	cseAlgorithm = "AES-256-GCM-64K"
+	cseChunkSize = 64 * 1024
+	cseOverhead  = 16
+
+	metaCSEAlgorithm = "cse-algorithm"
+	metaCSEKey       = "cse-key"
+	metaCSENonce     = "cse-nonce"
+)
+
+// metaOriginalMAC holds a keyed hmac of the plaintext of an encrypted object,
+// so that unchanged files can be detected without storing an unkeyed hash
+// of the plaintext next to the ciphertext.
+const metaOriginalMAC = "original-hmac"
+
+type ClientEncryption struct {
+	MasterKey []byte
+}
+
+func newGCM(key []byte) (cipher.AEAD, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
+
+func randomBytes(n int) ([]byte, error) {
+	b := make([]byte, n)
+	_, err := io.ReadFull(rand.Reader, b)
+	return b, err
+}
+
+// newMAC returns the hmac recorded in metaOriginalMAC, keyed with a key
+// derived from the master key rather than with the master key itself.
+func (e *ClientEncryption) newMAC() hash.Hash {
+	kdf := hmac.New(sha256.New, e.MasterKey)
+	kdf.Write([]byte("s3sync " + metaOriginalMAC))
+	return hmac.New(sha256.New, kdf.Sum(nil))
+}
+
+// macFile returns the hex metaOriginalMAC of the file at path.
+func (e *ClientEncryption) macFile(path string) (string, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return "", err
+	}
+	defer file.Close()
+
+	h := e.newMAC()
+	if _, err := io.Copy(h, file); err != nil {
+		return "", err
+	}
+	return fmt.Sprintf("%x", h.Sum(nil)), nil
+}
+
+func (e *ClientEncryption) wrapKey(dataKey []byte) (string, error) {
+	gcm, err := newGCM(e.MasterKey)
+	if err != nil {
+		return "", err
+	}
+	nonce, err := randomBytes(gcm.NonceSize())
+	if err != nil {
+		return "", err
+	}
+	sealed := gcm.Seal(nonce, nonce, dataKey, []byte(cseAlgorithm))
+	return base64.StdEncoding.EncodeToString(sealed), nil
+}
+
+func (e *ClientEncryption) unwrapKey(wrapped string) ([]byte, error) {
+	sealed, err := base64.StdEncoding.DecodeString(wrapped)
+	if err != nil {
+		return nil, err
+	}
+	gcm, err := newGCM(e.MasterKey)
+	if err != nil {
+		return nil, err
+	}
+	if len(sealed) < gcm.NonceSize() {
+		return nil, errors.New("wrapped data key too short")
+	}
+	nonce := sealed[:gcm.NonceSize()]
+	return gcm.Open(nil, nonce, sealed[gcm.NonceSize():], []byte(cseAlgorithm))
+}
+
+// encryptBody replaces the body of in with an encrypted stream of file and
+// records the wrapped data key and the plaintext size in metadata. The
+// caller records the metaOriginalMAC once it read the body.
+func (e *ClientEncryption) encryptBody(in *localToS3Input, file localFile) (*encryptReader, error) {
+	dataKey, err := randomBytes(32)
+	if err != nil {
+		return nil, err
+	}
+	wrapped, err := e.wrapKey(dataKey)
+	if err != nil {
+		return nil, err
+	}
+	gcm, err := newGCM(dataKey)
+	if err != nil {
+		return nil, err
+	}
+	nonce, err := randomBytes(gcm.NonceSize())
+	if err != nil {
+		return nil, err
+	}
+
+	body := &encryptReader{
+		gcm:   gcm,
+		nonce: nonce,
+		src:   file,
+		size:  in.Info.Size(),
+		chunk: -1,
+	}
+	in.Params.Body = body
+	if in.Params.Metadata == nil {
+		in.Params.Metadata = make(map[string]*string)
+	}
+	in.Params.Metadata[metaCSEAlgorithm] = aws.String(cseAlgorithm)
+	in.Params.Metadata[metaCSEKey] = aws.String(wrapped)
+	in.Params.Metadata[metaCSENonce] = aws.String(base64.StdEncoding.EncodeToString(nonce))
+	in.Params.Metadata[metaOriginalSize] = aws.String(fmt.Sprint(in.Info.Size()))
+	return body, nil
+}
+
+// decrypt writes the plaintext of an encrypted object body of size bytes.
+func (e *ClientEncryption) decrypt(w io.Writer, body io.Reader, size int64, metadata map[string]*string) error {
+	if alg := metadataValue(metadata, metaCSEAlgorithm); alg != cseAlgorithm {
+		return fmt.Errorf("unsupported client-side encryption %q", alg)
+	}
+	dataKey, err := e.unwrapKey(metadataValue(metadata, metaCSEKey))
+	if err != nil {
+		return err
+	}
+	nonce, err := base64.StdEncoding.DecodeString(metadataValue(metadata, metaCSENonce))
+	if err != nil {
+		return err
+	}
+	gcm, err := newGCM(dataKey)
+	if err != nil {
+		return err
+	}
+	if len(nonce) != gcm.NonceSize() {
+		return errors.New("invalid client-side encryption nonce")
+	}
+
+	chunks := cseChunks(size)
+	buf := make([]byte, cseChunkSize+cseOverhead)
+	for i := int64(0); i < chunks; i++ {
+		n := cseChunkSize + cseOverhead
+		if i == chunks-1 {
+			n = int(size - i*(cseChunkSize+cseOverhead))
+		}
+		if _, err := io.ReadFull(body, buf[:n]); err != nil {
+			return err
+		}
+		plain, err := gcm.Open(buf[:0], chunkNonce(nonce, i), buf[:n], chunkAAD(i == chunks-1))
+		if err != nil {
+			return err
+		}
+		if _, err := w.Write(plain); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// cseChunks returns the number of chunks in an encrypted object of size
+// bytes. Empty files are encrypted as a single empty chunk.
+func cseChunks(size int64) int64 {
+	chunks := (size + cseChunkSize + cseOverhead - 1) / (cseChunkSize + cseOverhead)
+	if chunks == 0 {
+		chunks = 1
+	}
+	return chunks
+}
+
+func chunkNonce(base []byte, i int64) []byte {
+	nonce := make([]byte, len(base))
+	copy(nonce, base)
+	counter := binary.BigEndian.Uint64(nonce[len(nonce)-8:])
+	binary.BigEndian.PutUint64(nonce[len(nonce)-8:], counter^uint64(i))
+	return nonce
+}
+
+// chunkAAD marks the final chunk so a truncated object fails to decrypt.
+func chunkAAD(final bool) []byte {
+	if final {
+		return []byte{1}
+	}
+	return []byte{0}
+}
+
+// encryptReader is a seekable ciphertext stream over a plaintext file,
+// sealing each chunk as it is read. If plain is set, the plaintext of each
+// chunk is written to it as the chunk is sealed.
+type encryptReader struct {
+	gcm   cipher.AEAD
+	nonce []byte
+	src   io.ReaderAt
+	size  int64
+	pos   int64
+	buf   []byte
+	chunk int64
+	plain io.Writer
+}
+
+func (r *encryptReader) chunks() int64 {
+	chunks := (r.size + cseChunkSize - 1) / cseChunkSize
+	if chunks == 0 {
+		chunks = 1
+	}
+	return chunks
+}
+
+func (r *encryptReader) length() int64 {
+	return r.size + r.chunks()*cseOverhead
+}
+
+func (r *encryptReader) seal(i int64) error {
+	start := i * cseChunkSize
+	end := start + cseChunkSize
+	if end > r.size {
+		end = r.size
+	}
+	plain := make([]byte, end-start)
+	if _, err := r.src.ReadAt(plain, start); err != nil && err != io.EOF {
+		return err
+	}
+	if r.plain != nil {
+		r.plain.Write(plain)
+	}
+	r.buf = r.gcm.Seal(r.buf[:0], chunkNonce(r.nonce, i), plain, chunkAAD(i == r.chunks()-1))
+	r.chunk = i
+	return nil
+}
+
+func (r *encryptReader) Read(p []byte) (int, error) {
+	if r.pos >= r.length() {
+		return 0, io.EOF
+	}
+	i := r.pos / (cseChunkSize + cseOverhead)
+	if i != r.chunk {
+		if err := r.seal(i); err != nil {
+			return 0, err
+		}
+	}
+	n := copy(p, r.buf[r.pos-i*(cseChunkSize+cseOverhead):])
+	r.pos += int64(n)
+	return n, nil
+}
+
+func (r *encryptReader) Seek(offset int64, whence int) (int64, error) {
+	switch whence {
+	case 0:
+	case 1:
+		offset += r.pos
+	case 2:
+		offset += r.length()
+	default:
+		return 0, errors.New("encryptReader.Seek: invalid whence")
+	}
+	if offset < 0 {
+		return 0, errors.New("encryptReader.Seek: negative position")
+	}
+	r.pos = offset
+	return offset, nil
+}
@@ -0,0 +1,169 @@
+package s3sync
+
+import (
+	"bytes"
+	"io"
+	"io/ioutil"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go/service/s3"
+)
+
+// testFileInfo is an os.FileInfo of a regular file of a given size.
+type testFileInfo struct {
+	name string
+	size int64
+	mode os.FileMode
+	mod  time.Time
+}
+
+func (fi testFileInfo) Name() string       { return fi.name }
+func (fi testFileInfo) Size() int64        { return fi.size }
+func (fi testFileInfo) Mode() os.FileMode  { return fi.mode }
+func (fi testFileInfo) ModTime() time.Time { return fi.mod }
+func (fi testFileInfo) IsDir() bool        { return fi.mode.IsDir() }
+func (fi testFileInfo) Sys() interface{}   { return nil }
+
+func testPlaintext(size int) []byte {
+	b := make([]byte, size)
+	for i := range b {
+		b[i] = byte(i * 7)
+	}
+	return b
+}
+
+// testEncrypt encrypts plain with e and returns the ciphertext, the
+// plaintext seen by the tee and the object metadata.
+func testEncrypt(t *testing.T, e *ClientEncryption, plain []byte) ([]byte, []byte, map[string]*string) {
+	in := &localToS3Input{
+		Params: &s3.PutObjectInput{},
+		Info:   testFileInfo{name: "f", size: int64(len(plain))},
+	}
+	body, err := e.encryptBody(in, bytes.NewReader(plain))
+	if err != nil {
+		t.Fatal(err)
+	}
+	tee := new(bytes.Buffer)
+	body.plain = tee
+	sealed, err := ioutil.ReadAll(body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if int64(len(sealed)) != body.length() {
+		t.Fatalf("read %d bytes, length is %d", len(sealed), body.length())
+	}
+	return sealed, tee.Bytes(), in.Params.Metadata
+}
+
+func TestClientEncryptionRoundTrip(t *testing.T) {
+	e := &ClientEncryption{MasterKey: bytes.Repeat([]byte{1}, 32)}
+	for _, size := range []int{0, 1, cseChunkSize - 1, cseChunkSize, cseChunkSize + 1, 3*cseChunkSize + 5} {
+		plain := testPlaintext(size)
+		sealed, teed, metadata := testEncrypt(t, e, plain)
+		if !bytes.Equal(teed, plain) {
+			t.Errorf("size %d: tee saw %d bytes, want the plaintext", size, len(teed))
+		}
+		if got := cseChunks(int64(len(sealed))); got != int64(len(sealed)-len(plain))/cseOverhead {
+			t.Errorf("size %d: cseChunks(%d) = %d", size, len(sealed), got)
+		}
+
+		out := new(bytes.Buffer)
+		if err := e.decrypt(out, bytes.NewReader(sealed), int64(len(sealed)), metadata); err != nil {
+			t.Errorf("size %d: decrypt: %v", size, err)
+			continue
+		}
+		if !bytes.Equal(out.Bytes(), plain) {
+			t.Errorf("size %d: decrypted plaintext differs", size)
+		}
+	}
+}
+
+func TestClientEncryptionTampered(t *testing.T) {
+	e := &ClientEncryption{MasterKey: bytes.Repeat([]byte{1}, 32)}
+	plain := testPlaintext(3 * cseChunkSize)
+	sealed, _, metadata := testEncrypt(t, e, plain)
+	chunk := cseChunkSize + cseOverhead
+
+	swapped := append([]byte(nil), sealed...)
+	copy(swapped, sealed[chunk:2*chunk])
+	copy(swapped[chunk:], sealed[:chunk])
+
+	flipped := append([]byte(nil), sealed...)
+	flipped[10] ^= 1
+
+	tests := []struct {
+		name     string
+		e        *ClientEncryption
+		body     []byte
+		metadata map[string]*string
+	}{
+		{"truncated", e, sealed[:2*chunk], metadata},
+		{"swapped chunks", e, swapped, metadata},
+		{"flipped bit", e, flipped, metadata},
+		{"wrong master key", &ClientEncryption{MasterKey: bytes.Repeat([]byte{2}, 32)}, sealed, metadata},
+		{"not encrypted", e, sealed, map[string]*string{}},
+	}
+	for _, tt := range tests {
+		err := tt.e.decrypt(ioutil.Discard, bytes.NewReader(tt.body), int64(len(tt.body)), tt.metadata)
+		if err == nil {
+			t.Errorf("%s: decrypt succeeded", tt.name)
+		}
+	}
+}
+
+func TestEncryptReaderSeek(t *testing.T) {
+	e := &ClientEncryption{MasterKey: bytes.Repeat([]byte{1}, 32)}
+	plain := testPlaintext(2*cseChunkSize + 100)
+	in := &localToS3Input{
+		Params: &s3.PutObjectInput{},
+		Info:   testFileInfo{name: "f", size: int64(len(plain))},
+	}
+	body, err := e.encryptBody(in, bytes.NewReader(plain))
+	if err != nil {
+		t.Fatal(err)
+	}
+	sealed, err := ioutil.ReadAll(body)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// A retried upload rewinds the body, and the signer may seek around it.
+	for _, offset := range []int64{0, 5, cseChunkSize + cseOverhead, int64(len(sealed)) - 3} {
+		if _, err := body.Seek(offset, 0); err != nil {
+			t.Fatal(err)
+		}
+		rest, err := ioutil.ReadAll(body)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(rest, sealed[offset:]) {
+			t.Errorf("reading from %d differs from the first read", offset)
+		}
+	}
+	if n, err := body.Seek(0, 2); err != nil || n != int64(len(sealed)) {
+		t.Errorf("Seek(0, 2) = %d, %v, want %d", n, err, len(sealed))
+	}
+	if _, err := body.Read(make([]byte, 1)); err != io.EOF {
+		t.Errorf("Read at the end = %v, want io.EOF", err)
+	}
+}
+
+func TestChunkNonce(t *testing.T) {
+	base := bytes.Repeat([]byte{0xaa}, 12)
+	seen := make(map[string]int64)
+	for i := int64(0); i < 1000; i++ {
+		nonce := string(chunkNonce(base, i))
+		if j, ok := seen[nonce]; ok {
+			t.Fatalf("chunks %d and %d share a nonce", j, i)
+		}
+		seen[nonce] = i
+	}
+	if !bytes.Equal(base, bytes.Repeat([]byte{0xaa}, 12)) {
+		t.Error("chunkNonce modified the base nonce")
+	}
+	if bytes.Equal(chunkAAD(true), chunkAAD(false)) {
+		t.Error("the final chunk has the same AAD as the others")
+	}
+}
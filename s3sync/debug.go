@@ -1,11 +1,24 @@
 package s3sync
 
-import "log"
+import (
+	"fmt"
+	"io"
+	"log"
+	"os"
+)
 
 var Debug = false
 
+// ReportOutput is where dry runs print the actions they would have taken.
+var ReportOutput io.Writer = os.Stdout
+
 func debug(v ...interface{}) {
 	if Debug {
 		log.Println(v...)
 	}
 }
+
+// report prints an action a dry run would have taken.
+func report(action, key string) {
+	fmt.Fprintf(ReportOutput, "%s\t%s\n", action, key)
+}
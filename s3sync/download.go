@@ -0,0 +1,323 @@
+package s3sync
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/s3"
+)
+
+func (s *S3Sync) syncS3ToLocal(bucket, prefix, target string, workers int) error {
+	prefix = cleanS3Path(prefix)
+
+	s3Svc, err := s.client()
+	if err != nil {
+		return err
+	}
+
+	bucketIndex, err := s.bucketIndex(bucket, prefix)
+	if err != nil {
+		return err
+	}
+
+	keyChan, wg := s.startDownloaders(s3Svc, workers)
+	for key, o := range bucketIndex {
+		if s.aborted() != nil {
+			break
+		}
+		if strings.HasSuffix(key, "/") || key == prefix+rulesStateName {
+			continue
+		}
+		path, err := localPath(target, strings.TrimPrefix(key, prefix))
+		if err != nil {
+			log.Println(err)
+			s.emitFailed("download", key, "", err)
+			continue
+		}
+		if info, err := os.Lstat(path); err == nil && info.Size() == *o.Size {
+			debug("Exists Size:", key)
+			s.emit(Event{Event: EventSkipped, Key: key, Path: path, Reason: "size"})
+			continue
+		}
+
+		s.emit(Event{Event: EventPlanned, Key: key, Path: path, Bytes: *o.Size})
+		keyChan <- &s3ToLocalInput{LocalPath: path, Root: target, Params: s.getParams(bucket, key)}
+	}
+	close(keyChan)
+
+	wg.Wait()
+
+	return s.aborted()
+}
+
+// localPath returns the path of the slash separated relPath below dir, and
+// an error if it would end up outside of dir, like keys containing "../".
+func localPath(dir, relPath string) (string, error) {
+	path := filepath.Join(dir, filepath.FromSlash(relPath))
+	rel, err := filepath.Rel(dir, path)
+	if err != nil || rel == ".." || strings.HasPrefix(rel, ".."+string(filepath.Separator)) {
+		return "", fmt.Errorf("%s: path is outside of %s", relPath, dir)
+	}
+	return path, nil
+}
+
+// symlinkParent returns an error if a directory between root and path is a
+// symlink, which would put path outside of root, like a key "link/x" after
+// "link" was restored as a symlink.
+func symlinkParent(root, path string) error {
+	if root == "" {
+		return nil
+	}
+	rel, err := filepath.Rel(root, filepath.Dir(path))
+	if err != nil || rel == "." {
+		return err
+	}
+	dir := root
+	for _, name := range strings.Split(rel, string(filepath.Separator)) {
+		dir = filepath.Join(dir, name)
+		info, err := os.Lstat(dir)
+		if os.IsNotExist(err) {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		if info.Mode()&os.ModeSymlink != 0 {
+			return fmt.Errorf("%s: %s is a symlink", path, dir)
+		}
+	}
+	return nil
+}
+
+// startDownloaders starts workers that download everything sent to the
+// returned channel until it is closed.
+func (s *S3Sync) startDownloaders(s3Svc *s3.S3, workers int) (chan *s3ToLocalInput, *sync.WaitGroup) {
+	keyChan := make(chan *s3ToLocalInput, workers*1000)
+	wg := new(sync.WaitGroup)
+	wg.Add(workers)
+	for i := 0; i < workers; i++ {
+		go func() {
+			defer wg.Done()
+			for k := range keyChan {
+				if s.aborted() != nil {
+					s.emit(Event{Event: EventSkipped, Key: *k.Params.Key, Path: k.LocalPath, Reason: "aborted"})
+					continue
+				}
+				s.busy(1)
+				s.downloadFile(s3Svc, k)
+				s.busy(-1)
+			}
+		}()
+	}
+	return keyChan, wg
+}
+
+func (s *S3Sync) getParams(bucket, key string) *s3.GetObjectInput {
+	params := &s3.GetObjectInput{
+		Bucket: aws.String(bucket),
+		Key:    aws.String(key),
+	}
+	if s.SSE.CustomerKey != nil {
+		params.SSECustomerAlgorithm = aws.String(s3.ServerSideEncryptionAes256)
+		params.SSECustomerKey = aws.String(string(s.SSE.CustomerKey))
+	}
+	return params
+}
+
+func (s *S3Sync) downloadFile(s3Svc *s3.S3, in *s3ToLocalInput) {
+	key := *in.Params.Key
+	if err := symlinkParent(in.Root, in.LocalPath); err != nil {
+		log.Print(err)
+		s.emitFailed("download", key, in.LocalPath, err)
+		return
+	}
+	if in.SHA256 != "" && in.materialized() {
+		s.emit(Event{Event: EventSkipped, Key: key, Path: in.LocalPath, Reason: "unchanged"})
+		return
+	}
+
+	current, err := s.localCurrent(s3Svc, in)
+	if err != nil {
+		log.Print(err)
+		s.emitFailed("download", key, in.LocalPath, err)
+		return
+	}
+	if current {
+		s.emit(Event{Event: EventSkipped, Key: key, Path: in.LocalPath, Reason: "original"})
+		return
+	}
+	if s.DryRun {
+		if _, err := os.Lstat(in.LocalPath); err == nil {
+			report("update", key)
+		} else {
+			report("new", key)
+		}
+		return
+	}
+
+	start := time.Now()
+	log.Println("START:", key, in.LocalPath)
+	s.emit(Event{Event: EventStarted, Action: "download", Key: key, Path: in.LocalPath})
+
+	n, err := s.fetch(s3Svc, in)
+	if err != nil {
+		log.Print(err)
+		s.emitFailed("download", key, in.LocalPath, err)
+	} else {
+		s.emit(Event{
+			Event:    EventCompleted,
+			Action:   "download",
+			Key:      key,
+			Path:     in.LocalPath,
+			Bytes:    n,
+			Duration: time.Since(start).Seconds(),
+		})
+	}
+
+	log.Printf("DONE (%s): %s %s", time.Since(start), key, in.LocalPath)
+}
+
+type s3ToLocalInput struct {
+	LocalPath string
+	Params    *s3.GetObjectInput
+
+	// Root, if set, is the directory LocalPath must stay in. Nothing is
+	// written through a symlink below it.
+	Root string
+
+	// ModTime, if set, is restored on the downloaded file. Mode, if set,
+	// is used instead of the mode metadata of the object.
+	ModTime time.Time
+	Mode    uint64
+
+	// SHA256 and Size, if set, describe the content of the object. A local
+	// file that already has them, and Mode, is not downloaded.
+	SHA256 string
+	Size   int64
+}
+
+// s3ToLocal downloads an object unless the local file is up to date, in
+// which case it returns -1.
+func (s *S3Sync) s3ToLocal(s3Svc *s3.S3, in *s3ToLocalInput) (int64, error) {
+	current, err := s.localCurrent(s3Svc, in)
+	if err != nil || current {
+		return -1, err
+	}
+	return s.fetch(s3Svc, in)
+}
+
+// localCurrent reports whether the local file of in already holds a
+// compressed or encrypted object, restoring its mtime if it does.
+func (s *S3Sync) localCurrent(s3Svc *s3.S3, in *s3ToLocalInput) (bool, error) {
+	if info, err := os.Lstat(in.LocalPath); err == nil && info.Mode().IsRegular() {
+		// HEAD first, so a compressed or encrypted copy of the local file is
+		// not downloaded just to find that it is up to date.
+		head, err := s3Svc.HeadObject(&s3.HeadObjectInput{
+			Bucket:               in.Params.Bucket,
+			Key:                  in.Params.Key,
+			SSECustomerAlgorithm: in.Params.SSECustomerAlgorithm,
+			SSECustomerKey:       in.Params.SSECustomerKey,
+		})
+		if err != nil {
+			return false, err
+		}
+		match, err := originalMatches(in.LocalPath, info.Size(), head.Metadata, s.Encryption)
+		if err != nil || !match {
+			return false, err
+		}
+		debug("Exists Original:", *in.Params.Key)
+		if !in.ModTime.IsZero() && !s.DryRun {
+			return true, os.Chtimes(in.LocalPath, in.ModTime, in.ModTime)
+		}
+		return true, nil
+	}
+	return false, nil
+}
+
+// fetch downloads an object, decrypting it if it was encrypted client side,
+// and restores symlinks and permissions from the mode metadata. It returns
+// the size of the object.
+func (s *S3Sync) fetch(s3Svc *s3.S3, in *s3ToLocalInput) (int64, error) {
+	// Ask for the stored bytes, so that net/http does not decode a gzip
+	// Content-Encoding that is part of the file rather than added by us.
+	req, resp := s3Svc.GetObjectRequest(in.Params)
+	req.HTTPRequest.Header.Set("Accept-Encoding", "identity")
+	if err := req.Send(); err != nil {
+		return 0, err
+	}
+	defer resp.Body.Close()
+
+	// Checked again around MkdirAll, as another worker may have created a
+	// symlink since downloadFile did.
+	if err := symlinkParent(in.Root, in.LocalPath); err != nil {
+		return 0, err
+	}
+	if err := os.MkdirAll(filepath.Dir(in.LocalPath), 0755); err != nil {
+		return 0, err
+	}
+	if err := symlinkParent(in.Root, in.LocalPath); err != nil {
+		return 0, err
+	}
+
+	mode, _ := strconv.ParseUint(metadataValue(resp.Metadata, "mode"), 10, 32)
+	if in.Mode != 0 {
+		mode = in.Mode
+	}
+	if mode&syscall.S_IFMT == syscall.S_IFLNK {
+		target, err := ioutil.ReadAll(resp.Body)
+		if err != nil {
+			return 0, err
+		}
+		os.Remove(in.LocalPath)
+		return int64(len(target)), os.Symlink(string(target), in.LocalPath)
+	}
+
+	tmp, err := ioutil.TempFile(filepath.Dir(in.LocalPath), ".s3sync")
+	if err != nil {
+		return 0, err
+	}
+	defer os.Remove(tmp.Name())
+
+	if metadataValue(resp.Metadata, metaCSEAlgorithm) != "" {
+		if s.Encryption == nil {
+			tmp.Close()
+			return 0, errors.New(*in.Params.Key + ": object is client-side encrypted and no master key is set")
+		}
+		err = s.Encryption.decrypt(tmp, resp.Body, aws.Int64Value(resp.ContentLength), resp.Metadata)
+	} else if metadataValue(resp.Metadata, metaOriginalSize) != "" {
+		err = decompress(tmp, resp.Body, aws.StringValue(resp.ContentEncoding))
+	} else {
+		_, err = io.Copy(tmp, resp.Body)
+	}
+	if cerr := tmp.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		return 0, err
+	}
+
+	perm := os.FileMode(0644)
+	if mode != 0 {
+		perm = os.FileMode(mode) & os.ModePerm
+	}
+	if err := os.Chmod(tmp.Name(), perm); err != nil {
+		return 0, err
+	}
+	if !in.ModTime.IsZero() {
+		if err := os.Chtimes(tmp.Name(), in.ModTime, in.ModTime); err != nil {
+			return 0, err
+		}
+	}
+	return aws.Int64Value(resp.ContentLength), os.Rename(tmp.Name(), in.LocalPath)
+}
@@ -0,0 +1,215 @@
+package s3sync
+
+import (
+	"bytes"
+	"crypto/md5"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/credentials"
+)
+
+// testObject is an object served by testS3.
+type testObject struct {
+	Body    []byte
+	Headers map[string]string
+	Tags    map[string]string
+}
+
+// testS3 serves ListObjects, HEAD, GET and GET ?tagging for the objects of
+// one bucket and counts the object GETs.
+type testS3 struct {
+	bucket  string
+	objects map[string]testObject
+
+	mu   sync.Mutex
+	gets int
+}
+
+func newTestS3(t *testing.T, bucket string, objects map[string]testObject) (*S3Sync, func()) {
+	fake := &testS3{bucket: bucket, objects: objects}
+	srv := httptest.NewServer(fake)
+	s := New(aws.NewConfig().
+		WithEndpoint(srv.URL).
+		WithRegion("us-east-1").
+		WithS3ForcePathStyle(true).
+		WithCredentials(credentials.NewStaticCredentials("id", "secret", "")))
+	return s, srv.Close
+}
+
+func (f *testS3) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	path := strings.TrimPrefix(r.URL.Path, "/"+f.bucket)
+	if path == "" || path == "/" {
+		f.list(w, r.URL.Query().Get("prefix"))
+		return
+	}
+	o, ok := f.objects[strings.TrimPrefix(path, "/")]
+	if !ok {
+		w.WriteHeader(http.StatusNotFound)
+		return
+	}
+	if _, ok := r.URL.Query()["tagging"]; ok {
+		fmt.Fprint(w, `<Tagging><TagSet>`)
+		for k, v := range o.Tags {
+			fmt.Fprintf(w, `<Tag><Key>%s</Key><Value>%s</Value></Tag>`, k, v)
+		}
+		fmt.Fprint(w, `</TagSet></Tagging>`)
+		return
+	}
+	for k, v := range o.Headers {
+		w.Header().Set(k, v)
+	}
+	w.Header().Set("Content-Length", fmt.Sprint(len(o.Body)))
+	w.Header().Set("ETag", testETag(o.Body))
+	if r.Method == "HEAD" {
+		return
+	}
+	f.mu.Lock()
+	f.gets++
+	f.mu.Unlock()
+	w.Write(o.Body)
+}
+
+func (f *testS3) list(w http.ResponseWriter, prefix string) {
+	var keys []string
+	for key := range f.objects {
+		if strings.HasPrefix(key, prefix) {
+			keys = append(keys, key)
+		}
+	}
+	sort.Strings(keys)
+	fmt.Fprintf(w, `<ListBucketResult><Name>%s</Name><IsTruncated>false</IsTruncated>`, f.bucket)
+	for _, key := range keys {
+		fmt.Fprintf(w, `<Contents><Key>%s</Key><Size>%d</Size><ETag>%s</ETag><LastModified>2015-08-27T10:00:00.000Z</LastModified></Contents>`,
+			key, len(f.objects[key].Body), testETag(f.objects[key].Body))
+	}
+	fmt.Fprint(w, `</ListBucketResult>`)
+}
+
+// testETag returns the ETag S3 gives an object with body.
+func testETag(body []byte) string {
+	return fmt.Sprintf(`"%x"`, md5.Sum(body))
+}
+
+func TestDryRunDownloadWritesNothing(t *testing.T) {
+	dir, err := ioutil.TempDir("", "s3sync")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	if err := ioutil.WriteFile(filepath.Join(dir, "changed.txt"), []byte("old"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	s, stop := newTestS3(t, "bucket", map[string]testObject{
+		"p/changed.txt": {Body: []byte("changed")},
+		"p/new/a.txt":   {Body: []byte("new")},
+	})
+	defer stop()
+	s.DryRun = true
+	if err := s.Sync("s3://bucket/p/", dir, 2); err != nil {
+		t.Fatal(err)
+	}
+
+	var files []string
+	filepath.Walk(dir, func(path string, info os.FileInfo, err error) error {
+		if err == nil && path != dir {
+			files = append(files, path)
+		}
+		return nil
+	})
+	if len(files) != 1 {
+		t.Errorf("dry run left %q in the target", files)
+	}
+	if data, _ := ioutil.ReadFile(filepath.Join(dir, "changed.txt")); string(data) != "old" {
+		t.Errorf("dry run overwrote changed.txt with %q", data)
+	}
+}
+
+func TestDownloadDecompresses(t *testing.T) {
+	dir, err := ioutil.TempDir("", "s3sync")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	plain := strings.Repeat("body { color: red }\n", 100)
+	objects := map[string]testObject{
+		// A file that was gzipped before it was synced is left as it is.
+		"p/archive.gz": {Body: []byte("\x1f\x8bnot ours"), Headers: map[string]string{"Content-Encoding": "gzip"}},
+	}
+	for _, encoding := range []string{CompressionGzip, CompressionBrotli} {
+		compressed := new(bytes.Buffer)
+		if err := compress(compressed, strings.NewReader(plain), encoding); err != nil {
+			t.Fatal(err)
+		}
+		objects["p/"+encoding+".css"] = testObject{
+			Body: compressed.Bytes(),
+			Headers: map[string]string{
+				"Content-Encoding":         encoding,
+				"X-Amz-Meta-Original-Size": fmt.Sprint(len(plain)),
+				"X-Amz-Meta-Original-Md5":  "unused",
+			},
+		}
+	}
+
+	s, stop := newTestS3(t, "bucket", objects)
+	defer stop()
+	if err := s.Sync("s3://bucket/p/", dir, 2); err != nil {
+		t.Fatal(err)
+	}
+	for _, encoding := range []string{CompressionGzip, CompressionBrotli} {
+		data, err := ioutil.ReadFile(filepath.Join(dir, encoding+".css"))
+		if err != nil || string(data) != plain {
+			t.Errorf("%s: downloaded %d bytes, %v, want the %d bytes of plaintext", encoding, len(data), err, len(plain))
+		}
+	}
+	if data, _ := ioutil.ReadFile(filepath.Join(dir, "archive.gz")); string(data) != "\x1f\x8bnot ours" {
+		t.Errorf("archive.gz was decoded to %q", data)
+	}
+}
+
+func TestDownloadRefusesSymlinkParent(t *testing.T) {
+	dir, err := ioutil.TempDir("", "s3sync")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	target, outside := filepath.Join(dir, "target"), filepath.Join(dir, "outside")
+	for _, d := range []string{target, outside} {
+		if err := os.Mkdir(d, 0755); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := os.Symlink(outside, filepath.Join(target, "link")); err != nil {
+		t.Fatal(err)
+	}
+
+	s, stop := newTestS3(t, "bucket", map[string]testObject{
+		"p/link/x":     {Body: []byte("escaped")},
+		"p/link/sub/y": {Body: []byte("escaped")},
+		"p/ok/z":       {Body: []byte("ok")},
+	})
+	defer stop()
+	if err := s.Sync("s3://bucket/p/", target, 2); err != nil {
+		t.Fatal(err)
+	}
+	if files, _ := ioutil.ReadDir(outside); len(files) != 0 {
+		t.Errorf("wrote %d entries through the symlink", len(files))
+	}
+	if data, _ := ioutil.ReadFile(filepath.Join(target, "ok", "z")); string(data) != "ok" {
+		t.Errorf("ok/z = %q", data)
+	}
+	if sum := s.Summary(); sum.Failed != 2 {
+		t.Errorf("%d downloads failed, want 2", sum.Failed)
+	}
+}
@@ -0,0 +1,71 @@
+package s3sync
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+
+	"github.com/aws/aws-sdk-go/aws"
+)
+
+// Endpoint points the client at S3 or an S3 compatible store such as MinIO
+// or Ceph RGW.
+type Endpoint struct {
+	URL            string
+	Region         string
+	ForcePathStyle bool
+	NoVerifySSL    bool
+	CABundle       string
+
+	// Connections is how many connections to keep open to the endpoint,
+	// at least one per worker.
+	Connections int
+}
+
+// Apply sets the endpoint options on config.
+func (e *Endpoint) Apply(config *aws.Config) error {
+	if e.URL != "" {
+		config.Endpoint = aws.String(e.URL)
+		if e.Region == "" {
+			// S3 compatible stores rarely care about the region, but
+			// requests can not be signed without one.
+			config.Region = aws.String("us-east-1")
+		}
+	}
+	if e.Region != "" {
+		config.Region = aws.String(e.Region)
+	}
+	if e.ForcePathStyle {
+		config.S3ForcePathStyle = aws.Bool(true)
+	}
+
+	// The default transport keeps only 2 idle connections per host, so
+	// most workers would connect again for every request.
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	if e.Connections > transport.MaxIdleConnsPerHost {
+		transport.MaxIdleConnsPerHost = e.Connections
+	}
+	if e.Connections > transport.MaxIdleConns {
+		transport.MaxIdleConns = e.Connections
+	}
+	config.HTTPClient = &http.Client{Transport: transport}
+
+	if !e.NoVerifySSL && e.CABundle == "" {
+		return nil
+	}
+	tlsConfig := &tls.Config{InsecureSkipVerify: e.NoVerifySSL}
+	if e.CABundle != "" {
+		pem, err := ioutil.ReadFile(e.CABundle)
+		if err != nil {
+			return err
+		}
+		tlsConfig.RootCAs = x509.NewCertPool()
+		if !tlsConfig.RootCAs.AppendCertsFromPEM(pem) {
+			return fmt.Errorf("%s: no certificates found", e.CABundle)
+		}
+	}
+	transport.TLSClientConfig = tlsConfig
+	return nil
+}
@@ -0,0 +1,137 @@
+package s3sync
+
+import (
+	"encoding/json"
+	"io"
+	"os"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws/awserr"
+)
+
+// Event is one line of the JSON event log.
+type Event struct {
+	Time       time.Time `json:"time"`
+	Event      string    `json:"event"`
+	Action     string    `json:"action,omitempty"`
+	Key        string    `json:"key,omitempty"`
+	Path       string    `json:"path,omitempty"`
+	Reason     string    `json:"reason,omitempty"`
+	Bytes      int64     `json:"bytes,omitempty"`
+	Duration   float64   `json:"duration,omitempty"`
+	ETag       string    `json:"etag,omitempty"`
+	Error      string    `json:"error,omitempty"`
+	ErrorClass string    `json:"error_class,omitempty"`
+
+	Summary *Summary `json:"summary,omitempty"`
+}
+
+// Summary counts the outcomes of a run.
+type Summary struct {
+	Planned   int64 `json:"planned"`
+	Skipped   int64 `json:"skipped"`
+	Completed int64 `json:"completed"`
+	Failed    int64 `json:"failed"`
+	Deleted   int64 `json:"deleted"`
+	Bytes     int64 `json:"bytes"`
+}
+
+// Event names.
+const (
+	EventPlanned   = "planned"
+	EventSkipped   = "skipped"
+	EventStarted   = "started"
+	EventCompleted = "completed"
+	EventFailed    = "failed"
+	EventDeleted   = "deleted"
+	EventSummary   = "summary"
+)
+
+// eventLog writes events as JSON, one object per line.
+type eventLog struct {
+	mu  sync.Mutex
+	enc *json.Encoder
+}
+
+// SetEventLog writes a JSON event for every sync decision and transfer to w.
+func (s *S3Sync) SetEventLog(w io.Writer) {
+	s.events = &eventLog{enc: json.NewEncoder(w)}
+}
+
+func (s *S3Sync) emit(e Event) {
+	switch e.Event {
+	case EventPlanned:
+		atomic.AddInt64(&s.summary.Planned, 1)
+	case EventSkipped:
+		atomic.AddInt64(&s.summary.Skipped, 1)
+	case EventCompleted:
+		atomic.AddInt64(&s.summary.Completed, 1)
+		atomic.AddInt64(&s.summary.Bytes, e.Bytes)
+	case EventFailed:
+		atomic.AddInt64(&s.summary.Failed, 1)
+	case EventDeleted:
+		atomic.AddInt64(&s.summary.Deleted, 1)
+	}
+
+	if s.Metrics != nil {
+		s.Metrics.observe(e)
+	}
+
+	if s.events == nil {
+		return
+	}
+	e.Time = time.Now().UTC()
+	s.events.mu.Lock()
+	defer s.events.mu.Unlock()
+	s.events.enc.Encode(e)
+}
+
+// Summary returns the counts of the run so far.
+func (s *S3Sync) Summary() Summary {
+	return Summary{
+		Planned:   atomic.LoadInt64(&s.summary.Planned),
+		Skipped:   atomic.LoadInt64(&s.summary.Skipped),
+		Completed: atomic.LoadInt64(&s.summary.Completed),
+		Failed:    atomic.LoadInt64(&s.summary.Failed),
+		Deleted:   atomic.LoadInt64(&s.summary.Deleted),
+		Bytes:     atomic.LoadInt64(&s.summary.Bytes),
+	}
+}
+
+// busy tracks the number of workers processing an object.
+func (s *S3Sync) busy(delta int64) {
+	if s.Metrics != nil {
+		s.Metrics.busy(delta)
+	}
+}
+
+func (s *S3Sync) emitSummary() {
+	summary := s.Summary()
+	s.emit(Event{Event: EventSummary, Summary: &summary})
+}
+
+func (s *S3Sync) emitFailed(action, key, path string, err error) {
+	s.emit(Event{
+		Event:      EventFailed,
+		Action:     action,
+		Key:        key,
+		Path:       path,
+		Error:      err.Error(),
+		ErrorClass: errorClass(err),
+	})
+	s.checkErrors(err)
+}
+
+// errorClass returns the AWS error code of err, or a coarse class for errors
+// that did not come from S3.
+func errorClass(err error) string {
+	switch err := err.(type) {
+	case awserr.Error:
+		return err.Code()
+	case *os.PathError, *os.LinkError:
+		return "LocalIOError"
+	}
+	return "Error"
+}
@@ -0,0 +1,103 @@
+package s3sync
+
+import (
+	"fmt"
+	"log"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/s3"
+)
+
+// guarded reports whether the plan has to be checked before it is run.
+func (s *S3Sync) guarded() bool {
+	return !s.Force && !s.DryRun && (s.MaxChanges > 0 || s.MaxChangesPercent > 0)
+}
+
+// checkPlan refuses a plan that would overwrite or delete more of the
+// existing objects than MaxChanges or MaxChangesPercent allow. Objects that
+// are only compared with their file before deciding, or whose metadata is
+// updated, are reported but not counted.
+func (s *S3Sync) checkPlan(existing int, planned []*localToS3Input, deletes int) error {
+	overwrites, verify := countChanges(planned)
+	changes := overwrites + deletes
+
+	percent := 0.0
+	if existing > 0 {
+		percent = 100 * float64(changes) / float64(existing)
+	}
+	if (s.MaxChanges > 0 && changes > s.MaxChanges) ||
+		(s.MaxChangesPercent > 0 && percent > s.MaxChangesPercent) {
+		return fmt.Errorf("refusing to overwrite %d and delete %d of %d existing objects (%.1f%%), use --force to sync anyway",
+			overwrites, deletes, existing, percent)
+	}
+	log.Printf("PLAN: %d new, %d overwritten, %d to verify, %d deleted of %d existing objects",
+		len(planned)-overwrites-verify, overwrites, verify, deletes, existing)
+	return nil
+}
+
+// countChanges returns how many of planned overwrite existing objects, and
+// how many only may, once the worker compared them with the object.
+func countChanges(planned []*localToS3Input) (overwrites, verify int) {
+	for _, in := range planned {
+		switch {
+		case !in.Exists:
+		case in.ContentMatches || in.VerifyOriginal || in.MetadataOnly:
+			verify++
+		default:
+			overwrites++
+		}
+	}
+	return overwrites, verify
+}
+
+// orphans returns the keys of bucketIndex that have no local file below
+// source, except the manifest, the rules state and keys of files that are
+// excluded.
+func (s *S3Sync) orphans(source, prefix string, bucketIndex S3KeyMap, seen map[string]*localToS3Input) []*s3.ObjectIdentifier {
+	manifest := ""
+	if name, err := manifestName(s.Manifest); err == nil {
+		manifest = prefix + name
+	}
+
+	var keys []string
+	for key := range bucketIndex {
+		if _, ok := seen[key]; ok || key == manifest || key == prefix+rulesStateName {
+			continue
+		}
+		if s.excludedKey(source, strings.TrimPrefix(key, prefix)) {
+			debug("Excluded:", key)
+			continue
+		}
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+
+	objects := make([]*s3.ObjectIdentifier, len(keys))
+	for i, key := range keys {
+		objects[i] = &s3.ObjectIdentifier{Key: aws.String(key)}
+	}
+	return objects
+}
+
+// excludedKey reports whether the file of the slash separated relPath below
+// source would be skipped by ExcludePatterns or ExcludeDirectories if it
+// existed.
+func (s *S3Sync) excludedKey(source, relPath string) bool {
+	path := filepath.Join(source, filepath.FromSlash(relPath))
+	for _, pattern := range s.ExcludePatterns {
+		if match, _ := filepath.Match(pattern, path); match {
+			return true
+		}
+	}
+	for dir := filepath.Dir(path); ; dir = filepath.Dir(dir) {
+		if s.excludedDir(dir) {
+			return true
+		}
+		if dir == filepath.Clean(source) || dir == filepath.Dir(dir) {
+			return false
+		}
+	}
+}
@@ -0,0 +1,101 @@
+package s3sync
+
+import (
+	"reflect"
+	"testing"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/s3"
+)
+
+// testPlanned returns n inputs of each kind checkPlan counts: new objects,
+// overwrites and ones the worker verifies first.
+func testPlanned(added, overwritten, verified int) []*localToS3Input {
+	var planned []*localToS3Input
+	for i := 0; i < added; i++ {
+		planned = append(planned, &localToS3Input{})
+	}
+	for i := 0; i < overwritten; i++ {
+		planned = append(planned, &localToS3Input{Exists: true})
+	}
+	for i := 0; i < verified; i++ {
+		switch i % 3 {
+		case 0:
+			planned = append(planned, &localToS3Input{Exists: true, ContentMatches: true})
+		case 1:
+			planned = append(planned, &localToS3Input{Exists: true, VerifyOriginal: true})
+		default:
+			planned = append(planned, &localToS3Input{Exists: true, MetadataOnly: true})
+		}
+	}
+	return planned
+}
+
+func TestCountChanges(t *testing.T) {
+	overwrites, verify := countChanges(testPlanned(4, 2, 5))
+	if overwrites != 2 || verify != 5 {
+		t.Errorf("countChanges = %d, %d, want 2, 5", overwrites, verify)
+	}
+}
+
+func TestCheckPlan(t *testing.T) {
+	tests := []struct {
+		name       string
+		maxChanges int
+		maxPercent float64
+		existing   int
+		planned    []*localToS3Input
+		deletes    int
+		ok         bool
+	}{
+		{"no limits", 0, 0, 10, testPlanned(0, 10, 0), 10, true},
+		{"at max changes", 5, 0, 100, testPlanned(0, 3, 0), 2, true},
+		{"over max changes", 5, 0, 100, testPlanned(0, 3, 0), 3, false},
+		{"new objects are not changes", 5, 0, 100, testPlanned(50, 0, 0), 0, true},
+		{"verified objects are not changes", 5, 0, 100, testPlanned(0, 0, 50), 0, true},
+		{"at max percent", 0, 10, 100, testPlanned(0, 5, 0), 5, true},
+		{"over max percent", 0, 10, 100, testPlanned(0, 6, 0), 5, false},
+		{"empty bucket", 0, 10, 0, testPlanned(20, 0, 0), 0, true},
+		{"either limit refuses", 100, 10, 100, testPlanned(0, 11, 0), 0, false},
+	}
+	for _, tt := range tests {
+		s := New(nil)
+		s.MaxChanges = tt.maxChanges
+		s.MaxChangesPercent = tt.maxPercent
+		err := s.checkPlan(tt.existing, tt.planned, tt.deletes)
+		if (err == nil) != tt.ok {
+			t.Errorf("%s: checkPlan = %v, want ok %v", tt.name, err, tt.ok)
+		}
+	}
+}
+
+func TestOrphans(t *testing.T) {
+	bucketIndex := make(S3KeyMap)
+	for _, key := range []string{
+		"p/kept.txt",
+		"p/gone.txt",
+		"p/SHA256SUMS",
+		"p/app.log",
+		"p/cache/data.bin",
+		"p/a/node_modules/x.js",
+		"p/a/b/gone.js",
+	} {
+		bucketIndex[key] = &s3.Object{Key: aws.String(key)}
+	}
+	seen := map[string]*localToS3Input{"p/kept.txt": {}}
+
+	s := New(nil)
+	s.Manifest = ManifestSHA256SUMS
+	s.ExcludePatterns = []string{"/src/*.log"}
+	s.ExcludeDirectories["/src/cache"] = true
+	s.ExcludeDirectories["node_modules"] = true
+
+	var got []string
+	for _, o := range s.orphans("/src", "p/", bucketIndex, seen) {
+		got = append(got, *o.Key)
+	}
+	want := []string{"p/a/b/gone.js", "p/gone.txt"}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("orphans = %q, want %q", got, want)
+	}
+}
@@ -0,0 +1,151 @@
+package s3sync
+
+import (
+	"fmt"
+	"log"
+	"net/url"
+	"os"
+	"strings"
+	"syscall"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/aws/aws-sdk-go/service/s3"
+)
+
+// maxCopySize is the largest object CopyObject can copy.
+const maxCopySize = 5 << 30
+
+// fileMetadata returns the user metadata stored alongside an uploaded file.
+func fileMetadata(info os.FileInfo) map[string]*string {
+	metadata := make(map[string]*string)
+	if stat_t, ok := info.Sys().(*syscall.Stat_t); ok {
+		metadata["mode"] = aws.String(fmt.Sprint(stat_t.Mode))
+		metadata["uid"] = aws.String(fmt.Sprint(stat_t.Uid))
+		metadata["gid"] = aws.String(fmt.Sprint(stat_t.Gid))
+	}
+	return metadata
+}
+
+// metadataEqual compares user metadata ignoring key case, since S3 returns
+// the keys canonicalized as HTTP headers.
+func metadataEqual(a, b map[string]*string) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	lower := make(map[string]string, len(b))
+	for k, v := range b {
+		lower[strings.ToLower(k)] = aws.StringValue(v)
+	}
+	for k, v := range a {
+		bv, ok := lower[strings.ToLower(k)]
+		if !ok || bv != aws.StringValue(v) {
+			return false
+		}
+	}
+	return true
+}
+
+func metadataValue(metadata map[string]*string, key string) string {
+	for k, v := range metadata {
+		if strings.EqualFold(k, key) {
+			return aws.StringValue(v)
+		}
+	}
+	return ""
+}
+
+func copySource(bucket, key string) string {
+	return (&url.URL{Path: bucket + "/" + key}).String()
+}
+
+// copyParams builds a self-copy of the object described by params, replacing
+// its metadata and headers with the ones in params.
+func copyParams(params *s3.PutObjectInput) *s3.CopyObjectInput {
+	return &s3.CopyObjectInput{
+		Bucket:                  params.Bucket,
+		Key:                     params.Key,
+		CopySource:              aws.String(copySource(*params.Bucket, *params.Key)),
+		MetadataDirective:       aws.String(s3.MetadataDirectiveReplace),
+		CacheControl:            params.CacheControl,
+		ContentDisposition:      params.ContentDisposition,
+		ContentEncoding:         params.ContentEncoding,
+		ContentLanguage:         params.ContentLanguage,
+		ContentType:             params.ContentType,
+		Expires:                 params.Expires,
+		WebsiteRedirectLocation: params.WebsiteRedirectLocation,
+		Metadata:                params.Metadata,
+		StorageClass:            params.StorageClass,
+		ACL:                     params.ACL,
+
+		ServerSideEncryption:           params.ServerSideEncryption,
+		SSEKMSKeyId:                    params.SSEKMSKeyId,
+		SSECustomerAlgorithm:           params.SSECustomerAlgorithm,
+		SSECustomerKey:                 params.SSECustomerKey,
+		CopySourceSSECustomerAlgorithm: params.SSECustomerAlgorithm,
+		CopySourceSSECustomerKey:       params.SSECustomerKey,
+	}
+}
+
+// compareRemote HEADs the object in is uploaded to and reports whether its
+// content and its metadata and headers are up to date.
+func compareRemote(s3Svc *s3.S3, in *localToS3Input) (bool, bool, error) {
+	req, head := s3Svc.HeadObjectRequest(&s3.HeadObjectInput{
+		Bucket:               in.Params.Bucket,
+		Key:                  in.Params.Key,
+		SSECustomerAlgorithm: in.Params.SSECustomerAlgorithm,
+		SSECustomerKey:       in.Params.SSECustomerKey,
+	})
+	if err := req.Send(); err != nil {
+		return false, false, err
+	}
+
+	if in.VerifyOriginal && in.SymlinkTarget != "" {
+		// A listed ETag that is the md5 of the content did not match.
+		remote := metadataValue(head.Metadata, metaSHA256)
+		if etagIsMD5(head.ServerSideEncryption, head.SSECustomerAlgorithm) ||
+			remote != sha256Hex(strings.NewReader(in.SymlinkTarget)) {
+			return false, false, nil
+		}
+		debug("Exists SHA256:", *in.Params.Key)
+	} else if in.VerifyOriginal {
+		encrypted := metadataValue(head.Metadata, metaCSEAlgorithm) != ""
+		if encrypted != (in.Encryption != nil) {
+			return false, false, nil
+		}
+		match, err := originalMatches(in.LocalPath, in.Info.Size(), head.Metadata, in.Encryption)
+		if err != nil || !match {
+			return false, false, err
+		}
+		debug("Exists Original:", *in.Params.Key)
+		adoptOriginal(in.Params, head)
+	}
+	// The content is current, so its checksum is too, and the manifest
+	// does not have to hash the file again.
+	if v := metadataValue(head.Metadata, metaSHA256); v != "" && in.Encryption == nil {
+		in.SHA256 = v
+		in.Params.Metadata[metaSHA256] = aws.String(v)
+	}
+
+	if !metadataEqual(in.Params.Metadata, head.Metadata) || !headersEqual(in.Params, head) {
+		return true, false, nil
+	}
+	tagsMatch, err := tagsEqual(s3Svc, in, req.HTTPResponse.Header.Get("x-amz-tagging-count"))
+	if err != nil || !tagsMatch {
+		return true, false, err
+	}
+	debug("Exists Metadata:", *in.Params.Key)
+	return true, true, nil
+}
+
+// updateMetadata refreshes the metadata and headers of an object whose
+// content is already up to date, using an in-place copy instead of
+// re-uploading the body. Objects over 5 GB can not be copied and fail.
+func updateMetadata(s3Svc *s3.S3, in *localToS3Input) error {
+	if in.Remote != nil && aws.Int64Value(in.Remote.Size) > maxCopySize {
+		return awserr.New("ObjectTooLarge", *in.Params.Key+" is over 5 GB, its metadata can only be replaced by uploading it again", nil)
+	}
+	log.Println("METADATA:", in.LocalPath, *in.Params.Key)
+	_, err := copyObject(s3Svc, copyParams(in.Params), in.Tags)
+	return err
+}
@@ -0,0 +1,164 @@
+package s3sync
+
+import (
+	"fmt"
+	"io"
+	"net/http"
+	"sort"
+	"strconv"
+	"sync"
+	"sync/atomic"
+
+	"github.com/aws/aws-sdk-go/aws/request"
+	"github.com/aws/aws-sdk-go/service/s3"
+)
+
+// Metrics collects counters of a running sync and serves them in the
+// Prometheus text format.
+type Metrics struct {
+	uploaded    int64
+	skipped     int64
+	failed      int64
+	bytesSent   int64
+	busyWorkers int64
+
+	mu       sync.Mutex
+	requests map[[2]string]int64
+	retries  map[string]int64
+	latency  *histogram
+	size     *histogram
+}
+
+func NewMetrics() *Metrics {
+	return &Metrics{
+		requests: make(map[[2]string]int64),
+		retries:  make(map[string]int64),
+		latency:  newHistogram(0.01, 0.05, 0.1, 0.25, 0.5, 1, 2.5, 5, 10, 30, 60, 300),
+		size:     newHistogram(1<<10, 16<<10, 128<<10, 1<<20, 8<<20, 64<<20, 512<<20, 1<<30, 5<<30),
+	}
+}
+
+func (m *Metrics) observe(e Event) {
+	switch e.Event {
+	case EventSkipped:
+		atomic.AddInt64(&m.skipped, 1)
+	case EventFailed:
+		atomic.AddInt64(&m.failed, 1)
+	case EventCompleted:
+		if e.Action != "upload" {
+			return
+		}
+		atomic.AddInt64(&m.uploaded, 1)
+		atomic.AddInt64(&m.bytesSent, e.Bytes)
+		m.mu.Lock()
+		m.latency.observe(e.Duration)
+		m.size.observe(float64(e.Bytes))
+		m.mu.Unlock()
+	}
+}
+
+func (m *Metrics) busy(delta int64) {
+	atomic.AddInt64(&m.busyWorkers, delta)
+}
+
+// instrument counts every request s3Svc sends, by operation and HTTP
+// status, and every retry.
+func (m *Metrics) instrument(s3Svc *s3.S3) {
+	s3Svc.Handlers.Send.PushBack(func(r *request.Request) {
+		status := "error"
+		if r.HTTPResponse != nil {
+			status = strconv.Itoa(r.HTTPResponse.StatusCode)
+		}
+		m.mu.Lock()
+		m.requests[[2]string{r.Operation.Name, status}]++
+		m.mu.Unlock()
+	})
+	s3Svc.Handlers.AfterRetry.PushBack(func(r *request.Request) {
+		// The core handler clears the error when the request is retried.
+		if r.Error != nil {
+			return
+		}
+		m.mu.Lock()
+		m.retries[r.Operation.Name]++
+		m.mu.Unlock()
+	})
+}
+
+func (m *Metrics) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+	m.write(w)
+}
+
+// write writes the metrics in the Prometheus text format.
+func (m *Metrics) write(w io.Writer) {
+	counter(w, "s3sync_objects_uploaded_total", "Objects uploaded.", atomic.LoadInt64(&m.uploaded))
+	counter(w, "s3sync_objects_skipped_total", "Objects skipped as up to date or excluded.", atomic.LoadInt64(&m.skipped))
+	counter(w, "s3sync_objects_failed_total", "Objects that failed to transfer.", atomic.LoadInt64(&m.failed))
+	counter(w, "s3sync_bytes_sent_total", "Bytes of local files uploaded.", atomic.LoadInt64(&m.bytesSent))
+	fmt.Fprintf(w, "# HELP s3sync_busy_workers Workers currently processing an object.\n")
+	fmt.Fprintf(w, "# TYPE s3sync_busy_workers gauge\n")
+	fmt.Fprintf(w, "s3sync_busy_workers %d\n", atomic.LoadInt64(&m.busyWorkers))
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	fmt.Fprintf(w, "# HELP s3sync_requests_total S3 requests sent, by operation and HTTP status.\n")
+	fmt.Fprintf(w, "# TYPE s3sync_requests_total counter\n")
+	requests := make([]string, 0, len(m.requests))
+	for k, v := range m.requests {
+		requests = append(requests, fmt.Sprintf("s3sync_requests_total{operation=%q,status=%q} %d\n", k[0], k[1], v))
+	}
+	sort.Strings(requests)
+	for _, line := range requests {
+		io.WriteString(w, line)
+	}
+
+	fmt.Fprintf(w, "# HELP s3sync_retries_total S3 requests retried, by operation.\n")
+	fmt.Fprintf(w, "# TYPE s3sync_retries_total counter\n")
+	operations := make([]string, 0, len(m.retries))
+	for op := range m.retries {
+		operations = append(operations, op)
+	}
+	sort.Strings(operations)
+	for _, op := range operations {
+		fmt.Fprintf(w, "s3sync_retries_total{operation=%q} %d\n", op, m.retries[op])
+	}
+
+	m.latency.write(w, "s3sync_upload_duration_seconds", "Time taken to upload an object.")
+	m.size.write(w, "s3sync_upload_size_bytes", "Size of uploaded objects.")
+}
+
+func counter(w io.Writer, name, help string, v int64) {
+	fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s counter\n%s %d\n", name, help, name, name, v)
+}
+
+type histogram struct {
+	bounds []float64
+	counts []int64
+	sum    float64
+	count  int64
+}
+
+func newHistogram(bounds ...float64) *histogram {
+	return &histogram{bounds: bounds, counts: make([]int64, len(bounds))}
+}
+
+func (h *histogram) observe(v float64) {
+	for i, bound := range h.bounds {
+		if v <= bound {
+			h.counts[i]++
+		}
+	}
+	h.sum += v
+	h.count++
+}
+
+func (h *histogram) write(w io.Writer, name, help string) {
+	fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s histogram\n", name, help, name)
+	for i, bound := range h.bounds {
+		fmt.Fprintf(w, "%s_bucket{le=\"%s\"} %d\n", name, strconv.FormatFloat(bound, 'g', -1, 64), h.counts[i])
+	}
+	fmt.Fprintf(w, "%s_bucket{le=\"+Inf\"} %d\n", name, h.count)
+	fmt.Fprintf(w, "%s_sum %s\n", name, strconv.FormatFloat(h.sum, 'g', -1, 64))
+	fmt.Fprintf(w, "%s_count %d\n", name, h.count)
+}
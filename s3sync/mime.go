@@ -1,6 +1,16 @@
 package s3sync
 
-import "mime"
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"log"
+	"mime"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+)
 
 func init() {
 	mime.AddExtensionType(".mar", "application/octet-stream")
@@ -12,4 +22,86 @@ func init() {
 	mime.AddExtensionType(".install", "application/x-install-instructions")
 	mime.AddExtensionType(".jar", "application/x-java-archive")
 	mime.AddExtensionType(".xpi", "application/x-xpinstall")
+	mime.AddExtensionType(".wasm", "application/wasm")
+	mime.AddExtensionType(".webmanifest", "application/manifest+json")
+	mime.AddExtensionType(".avif", "image/avif")
+}
+
+// LoadMimeTypes registers the extension mappings in a mime.types formatted
+// file: a type followed by its extensions, one type per line.
+func LoadMimeTypes(path string) error {
+	f, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	scanner := bufio.NewScanner(f)
+	for line := 1; scanner.Scan(); line++ {
+		fields := strings.Fields(scanner.Text())
+		if len(fields) == 0 || strings.HasPrefix(fields[0], "#") {
+			continue
+		}
+		for _, ext := range fields[1:] {
+			if strings.HasPrefix(ext, "#") {
+				break
+			}
+			err := mime.AddExtensionType("."+strings.TrimPrefix(ext, "."), fields[0])
+			if err != nil {
+				return fmt.Errorf("%s:%d: %s", path, line, err)
+			}
+		}
+	}
+	return scanner.Err()
+}
+
+// ContentType returns the Content-Type uploads of path get by extension,
+// without sniffing or a charset.
+func ContentType(path string) string {
+	return new(S3Sync).contentType(path, nil)
+}
+
+// sniffContentType guesses the type of a local file from its first 512 bytes.
+func sniffContentType(path string) (string, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+
+	buf := make([]byte, 512)
+	n, err := io.ReadFull(f, buf)
+	if err != nil && err != io.EOF && err != io.ErrUnexpectedEOF {
+		return "", err
+	}
+	return http.DetectContentType(buf[:n]), nil
+}
+
+func isText(ctype string) bool {
+	mediaType, _, _ := mime.ParseMediaType(ctype)
+	switch mediaType {
+	case "application/javascript", "application/json", "application/xml",
+		"application/manifest+json", "image/svg+xml":
+		return true
+	}
+	return strings.HasPrefix(mediaType, "text/")
+}
+
+func (s *S3Sync) contentType(path string, info os.FileInfo) string {
+	ctype := mime.TypeByExtension(filepath.Ext(path))
+	if ctype == "" && s.SniffContentType && info.Mode().IsRegular() {
+		sniffed, err := sniffContentType(path)
+		if err != nil {
+			log.Println("sniffContentType", err)
+		}
+		ctype = sniffed
+	}
+	if ctype == "" {
+		ctype = "application/octet-stream"
+	}
+
+	if s.CharsetUTF8 && isText(ctype) && !strings.Contains(ctype, "charset=") {
+		ctype += "; charset=utf-8"
+	}
+	return ctype
 }
@@ -0,0 +1,84 @@
+package s3sync
+
+import (
+	"fmt"
+	"log"
+	"strings"
+)
+
+// ParsePhase splits a comma separated list of patterns.
+func ParsePhase(s string) []string {
+	var patterns []string
+	for _, pattern := range strings.Split(s, ",") {
+		if pattern = strings.TrimSpace(pattern); pattern != "" {
+			patterns = append(patterns, pattern)
+		}
+	}
+	return patterns
+}
+
+// phaseOf returns the phase relPath is uploaded in: 0 if it matches none of
+// Phases, otherwise 1 plus the index of the first phase with a matching
+// pattern.
+func (s *S3Sync) phaseOf(relPath string) int {
+	for i, patterns := range s.Phases {
+		for _, pattern := range patterns {
+			if matchPattern(pattern, relPath) {
+				return i + 1
+			}
+		}
+	}
+	return 0
+}
+
+// release queues the files held by q. With Phases, it queues them one phase
+// at a time and waits for each to finish before starting the next. If files
+// of a phase fail, the later phases are skipped so that no file is published
+// before the files it depends on.
+func (s *S3Sync) release(q *uploadQueue) error {
+	if len(s.Phases) == 0 {
+		q.release()
+		return nil
+	}
+
+	phases := make([][]*localToS3Input, len(s.Phases)+1)
+	for _, in := range q.held {
+		phase := s.phaseOf(in.RelPath)
+		phases[phase] = append(phases[phase], in)
+	}
+	q.hold, q.held = false, nil
+
+	for i, files := range phases {
+		if len(files) == 0 {
+			continue
+		}
+		log.Printf("PHASE %d/%d: %d files", i+1, len(phases), len(files))
+		failed := s.Summary().Failed
+		for _, in := range files {
+			q.add(in)
+		}
+		q.drain()
+
+		if err := s.aborted(); err != nil {
+			return err
+		}
+		if n := s.Summary().Failed - failed; n > 0 {
+			s.skipPhases(phases[i+1:])
+			return fmt.Errorf("%d files of phase %d failed, later phases were not uploaded", n, i+1)
+		}
+	}
+	return nil
+}
+
+// skipPhases reports the files of phases as skipped and adds them to the
+// failed list, so that they are synced with the files that failed.
+func (s *S3Sync) skipPhases(phases [][]*localToS3Input) {
+	s.failedMu.Lock()
+	defer s.failedMu.Unlock()
+	for _, files := range phases {
+		for _, in := range files {
+			s.emit(Event{Event: EventSkipped, Key: *in.Params.Key, Path: in.LocalPath, Reason: "phase"})
+			s.failed = append(s.failed, in.RelPath)
+		}
+	}
+}
@@ -0,0 +1,373 @@
+package s3sync
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/s3"
+)
+
+// planVersion is the format version of plan files.
+const planVersion = 3
+
+// A Plan records what a sync of Source to Target would do, and the state of
+// the files and objects it was based on, so that it can be reviewed and then
+// applied exactly.
+type Plan struct {
+	Version int          `json:"version"`
+	Created time.Time    `json:"created"`
+	Source  string       `json:"source"`
+	Target  string       `json:"target"`
+	Phases  [][]string   `json:"phases,omitempty"`
+	Actions []PlanAction `json:"actions"`
+
+	mu sync.Mutex
+}
+
+// A PlanAction is an upload, metadata update or delete of one key, or a key
+// left alone because it is unchanged.
+type PlanAction struct {
+	Action string       `json:"action"`
+	Key    string       `json:"key"`
+	Path   string       `json:"path,omitempty"`
+	Local  *Fingerprint `json:"local,omitempty"`
+	Remote *Fingerprint `json:"remote,omitempty"`
+
+	// The request an upload or metadata update sends, without SSE-C keys.
+	Params   *planParams       `json:"params,omitempty"`
+	Tags     map[string]string `json:"tags,omitempty"`
+	Compress string            `json:"compress,omitempty"`
+	Encrypt  bool              `json:"encrypt,omitempty"`
+}
+
+// planParams is a PutObjectInput that leaves unset fields out of JSON.
+type planParams struct {
+	*s3.PutObjectInput
+}
+
+func (p planParams) MarshalJSON() ([]byte, error) {
+	data, err := json.Marshal(p.PutObjectInput)
+	if err != nil {
+		return nil, err
+	}
+	var fields map[string]interface{}
+	if err := json.Unmarshal(data, &fields); err != nil {
+		return nil, err
+	}
+	for k, v := range fields {
+		if v == nil {
+			delete(fields, k)
+		}
+	}
+	return json.Marshal(fields)
+}
+
+func (p *planParams) UnmarshalJSON(data []byte) error {
+	p.PutObjectInput = new(s3.PutObjectInput)
+	return json.Unmarshal(data, p.PutObjectInput)
+}
+
+// A Fingerprint identifies the version of a local file or remote object.
+type Fingerprint struct {
+	Size    int64      `json:"size"`
+	ModTime *time.Time `json:"mtime,omitempty"`
+	Inode   uint64     `json:"inode,omitempty"`
+	ETag    string     `json:"etag,omitempty"`
+}
+
+func localFingerprint(info os.FileInfo) *Fingerprint {
+	mtime := info.ModTime()
+	f := &Fingerprint{Size: info.Size(), ModTime: &mtime}
+	if stat_t, ok := info.Sys().(*syscall.Stat_t); ok {
+		f.Inode = uint64(stat_t.Ino)
+	}
+	return f
+}
+
+func remoteFingerprint(o *s3.Object) *Fingerprint {
+	if o == nil {
+		return nil
+	}
+	return &Fingerprint{Size: aws.Int64Value(o.Size), ETag: aws.StringValue(o.ETag)}
+}
+
+func (f *Fingerprint) equal(g *Fingerprint) bool {
+	if f == nil || g == nil {
+		return f == g
+	}
+	if (f.ModTime == nil) != (g.ModTime == nil) || (f.ModTime != nil && !f.ModTime.Equal(*g.ModTime)) {
+		return false
+	}
+	return f.Size == g.Size && f.Inode == g.Inode && f.ETag == g.ETag
+}
+
+// Plan runs a dry run of syncing source to target and returns what it would
+// do.
+func (s *S3Sync) Plan(source, target string, workers int) (*Plan, error) {
+	if !isLocalPath(source) || !isS3Path(target) {
+		return nil, errors.New("Plans can only sync a local directory to S3")
+	}
+	abs, err := filepath.Abs(source)
+	if err != nil {
+		return nil, err
+	}
+
+	s.DryRun = true
+	s.plan = &Plan{Version: planVersion, Created: time.Now().UTC(), Source: abs, Target: target, Phases: s.Phases}
+	if err := s.Sync(source, target, workers); err != nil {
+		return nil, err
+	}
+
+	sort.Sort(byActionKey(s.plan.Actions))
+	return s.plan, nil
+}
+
+// dryRun reports an action a dry run would have taken and adds it to the
+// plan being made.
+func (s *S3Sync) dryRun(action string, in *localToS3Input) {
+	report(action, *in.Params.Key)
+	if s.plan == nil {
+		return
+	}
+
+	params := *in.Params
+	params.Body = nil
+	params.SSECustomerKey = nil
+	params.SSECustomerKeyMD5 = nil
+	a := PlanAction{
+		Action:   "upload",
+		Key:      *in.Params.Key,
+		Path:     in.RelPath,
+		Local:    localFingerprint(in.Info),
+		Remote:   remoteFingerprint(in.Remote),
+		Params:   &planParams{&params},
+		Tags:     in.Tags,
+		Compress: in.Compress,
+		Encrypt:  in.Encryption != nil,
+	}
+	if action == "metadata" {
+		a.Action = action
+	}
+
+	s.plan.mu.Lock()
+	s.plan.Actions = append(s.plan.Actions, a)
+	s.plan.mu.Unlock()
+}
+
+// addUnchanged records a file that is not uploaded, so that Apply checks it
+// did not change either.
+func (p *Plan) addUnchanged(in *localToS3Input) {
+	if p == nil {
+		return
+	}
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.Actions = append(p.Actions, PlanAction{
+		Action: "unchanged",
+		Key:    *in.Params.Key,
+		Path:   in.RelPath,
+		Local:  localFingerprint(in.Info),
+		Remote: remoteFingerprint(in.Remote),
+	})
+}
+
+// addDeletes records deletes of objects below prefix, with the path of the
+// local file whose absence they are based on.
+func (p *Plan) addDeletes(prefix string, objects []*s3.ObjectIdentifier, bucketIndex S3KeyMap) {
+	if p == nil {
+		return
+	}
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	for _, o := range objects {
+		key := aws.StringValue(o.Key)
+		p.Actions = append(p.Actions, PlanAction{
+			Action: "delete",
+			Key:    key,
+			Path:   filepath.FromSlash(strings.TrimPrefix(key, prefix)),
+			Remote: remoteFingerprint(bucketIndex[key]),
+		})
+	}
+}
+
+type byActionKey []PlanAction
+
+func (b byActionKey) Len() int      { return len(b) }
+func (b byActionKey) Swap(i, j int) { b[i], b[j] = b[j], b[i] }
+func (b byActionKey) Less(i, j int) bool {
+	if b[i].Action != b[j].Action {
+		return b[i].Action > b[j].Action
+	}
+	return b[i].Key < b[j].Key
+}
+
+// WritePlan writes p to path.
+func WritePlan(path string, p *Plan) error {
+	data, err := json.MarshalIndent(p, "", "  ")
+	if err != nil {
+		return err
+	}
+	return ioutil.WriteFile(path, append(data, '\n'), 0644)
+}
+
+// LoadPlan reads a plan written by WritePlan.
+func LoadPlan(path string) (*Plan, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	p := new(Plan)
+	if err := json.Unmarshal(data, p); err != nil {
+		return nil, fmt.Errorf("%s: %v", path, err)
+	}
+	if p.Version != planVersion {
+		return nil, fmt.Errorf("%s: unsupported plan version %d", path, p.Version)
+	}
+	return p, nil
+}
+
+// Apply runs the actions of p. It refuses to if any of the files or objects
+// p was based on have changed since.
+func (s *S3Sync) Apply(p *Plan, workers int) error {
+	if err := s.SSE.Validate(); err != nil {
+		return err
+	}
+	s3url, err := parseS3Path(p.Target)
+	if err != nil {
+		return err
+	}
+	bucket, prefix := s3url.Host, cleanS3Path(s3url.Path)
+
+	s3Svc, err := s.client()
+	if err != nil {
+		return err
+	}
+	bucketIndex, err := s.bucketIndex(bucket, prefix)
+	if err != nil {
+		return err
+	}
+	defer s.emitSummary()
+
+	var uploads []*localToS3Input
+	var deletes []*s3.ObjectIdentifier
+	stale := 0
+	for _, a := range p.Actions {
+		if remote := remoteFingerprint(bucketIndex[a.Key]); !remote.equal(a.Remote) {
+			log.Printf("CHANGED: %s changed since the plan was made", a.Key)
+			stale++
+			continue
+		}
+		if a.Action == "unchanged" {
+			info, err := os.Lstat(filepath.Join(p.Source, a.Path))
+			if err != nil || !localFingerprint(info).equal(a.Local) {
+				log.Printf("CHANGED: %s changed since the plan was made", a.Path)
+				stale++
+			}
+			continue
+		}
+		if a.Action == "delete" {
+			if a.Path != "" {
+				if info, err := os.Lstat(filepath.Join(p.Source, a.Path)); err == nil && !info.IsDir() {
+					log.Printf("CHANGED: %s was created since the plan was made", a.Path)
+					stale++
+					continue
+				}
+			}
+			deletes = append(deletes, &s3.ObjectIdentifier{Key: aws.String(a.Key)})
+			continue
+		}
+
+		in, err := s.planInput(p, bucket, a)
+		if err != nil {
+			log.Println(err)
+			stale++
+			continue
+		}
+		uploads = append(uploads, in)
+	}
+	if stale > 0 {
+		return fmt.Errorf("%d files or objects changed since the plan was made, make a new plan", stale)
+	}
+	if s.guarded() {
+		if err := s.checkPlan(len(bucketIndex), uploads, len(deletes)); err != nil {
+			return err
+		}
+	}
+
+	s.Phases = p.Phases
+	q := s.startUploaders(s3Svc, workers)
+	q.hold = true
+	for _, in := range uploads {
+		s.emit(Event{Event: EventPlanned, Key: *in.Params.Key, Path: in.LocalPath, Bytes: in.size()})
+		q.add(in)
+	}
+	phaseErr := s.release(q)
+	q.wait()
+
+	if s.FailedList != "" {
+		if err := s.writeFailedList(); err != nil {
+			return err
+		}
+	}
+	if err := s.aborted(); err != nil {
+		return err
+	}
+	if phaseErr != nil {
+		return phaseErr
+	}
+	s.deleteKeys(s3Svc, bucket, deletes)
+	return s.aborted()
+}
+
+// planInput rebuilds the upload of a, checking that the local file did not
+// change since the plan was made.
+func (s *S3Sync) planInput(p *Plan, bucket string, a PlanAction) (*localToS3Input, error) {
+	if a.Params == nil {
+		return nil, fmt.Errorf("%s: %s without params", a.Key, a.Action)
+	}
+	path := filepath.Join(p.Source, a.Path)
+	info, err := os.Lstat(path)
+	if err != nil {
+		return nil, err
+	}
+	if !localFingerprint(info).equal(a.Local) {
+		return nil, fmt.Errorf("CHANGED: %s changed since the plan was made", path)
+	}
+
+	in, err := s.newLocalToS3Input(path, a.Path, bucket, a.Key, info)
+	if err != nil {
+		return nil, err
+	}
+	in.Params = a.Params.PutObjectInput
+	in.Params.Bucket = aws.String(bucket)
+	in.Params.Key = aws.String(a.Key)
+	if in.Params.SSECustomerAlgorithm != nil {
+		if s.SSE.CustomerKey == nil {
+			return nil, fmt.Errorf("%s: the plan uses SSE-C, a key is required", a.Key)
+		}
+		in.Params.SSECustomerKey = aws.String(string(s.SSE.CustomerKey))
+	}
+	in.Tags = a.Tags
+	in.Compress = a.Compress
+	in.Encryption = nil
+	if a.Encrypt {
+		if s.Encryption == nil {
+			return nil, fmt.Errorf("%s: the plan encrypts, an encryption key is required", a.Key)
+		}
+		in.Encryption = s.Encryption
+	}
+	in.Exists = a.Remote != nil
+	in.MetadataOnly = a.Action == "metadata"
+	return in, nil
+}
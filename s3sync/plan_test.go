@@ -0,0 +1,151 @@
+package s3sync
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/s3"
+)
+
+func TestFingerprintEqual(t *testing.T) {
+	now := time.Now()
+	later := now.Add(time.Second)
+	utc := now.UTC()
+	f := &Fingerprint{Size: 3, ModTime: &now, Inode: 7}
+
+	tests := []struct {
+		name string
+		a, b *Fingerprint
+		want bool
+	}{
+		{"both nil", nil, nil, true},
+		{"one nil", f, nil, false},
+		{"other nil", nil, f, false},
+		{"same", f, &Fingerprint{Size: 3, ModTime: &now, Inode: 7}, true},
+		{"same instant in another zone", f, &Fingerprint{Size: 3, ModTime: &utc, Inode: 7}, true},
+		{"size", f, &Fingerprint{Size: 4, ModTime: &now, Inode: 7}, false},
+		{"mtime", f, &Fingerprint{Size: 3, ModTime: &later, Inode: 7}, false},
+		{"no mtime", f, &Fingerprint{Size: 3, Inode: 7}, false},
+		{"inode", f, &Fingerprint{Size: 3, ModTime: &now, Inode: 8}, false},
+		{"etag", &Fingerprint{Size: 3, ETag: `"a"`}, &Fingerprint{Size: 3, ETag: `"b"`}, false},
+		{"remote", &Fingerprint{Size: 3, ETag: `"a"`}, &Fingerprint{Size: 3, ETag: `"a"`}, true},
+	}
+	for _, tt := range tests {
+		if got := tt.a.equal(tt.b); got != tt.want {
+			t.Errorf("%s: equal = %v, want %v", tt.name, got, tt.want)
+		}
+	}
+}
+
+func TestPlanInput(t *testing.T) {
+	dir, err := ioutil.TempDir("", "s3sync")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	write := func(name, content string) *Fingerprint {
+		path := filepath.Join(dir, name)
+		if err := ioutil.WriteFile(path, []byte(content), 0644); err != nil {
+			t.Fatal(err)
+		}
+		mtime := time.Unix(1500000000, 0)
+		if err := os.Chtimes(path, mtime, mtime); err != nil {
+			t.Fatal(err)
+		}
+		info, err := os.Lstat(path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return localFingerprint(info)
+	}
+	same := write("same.txt", "abc")
+	grown := write("grown.txt", "abc")
+	write("grown.txt", "abcd")
+	touched := write("touched.txt", "abc")
+	if err := os.Chtimes(filepath.Join(dir, "touched.txt"), time.Now(), time.Now()); err != nil {
+		t.Fatal(err)
+	}
+	removed := write("removed.txt", "abc")
+	os.Remove(filepath.Join(dir, "removed.txt"))
+
+	params := func() *planParams {
+		return &planParams{&s3.PutObjectInput{ContentType: aws.String("text/plain")}}
+	}
+	ssec := params()
+	ssec.SSECustomerAlgorithm = aws.String("AES256")
+
+	tests := []struct {
+		name   string
+		action PlanAction
+		err    string
+	}{
+		{"unchanged", PlanAction{Action: "new", Key: "p/same.txt", Path: "same.txt", Local: same, Params: params()}, ""},
+		{"grown", PlanAction{Action: "new", Key: "p/grown.txt", Path: "grown.txt", Local: grown, Params: params()}, "changed since the plan was made"},
+		{"touched", PlanAction{Action: "new", Key: "p/touched.txt", Path: "touched.txt", Local: touched, Params: params()}, "changed since the plan was made"},
+		{"removed", PlanAction{Action: "new", Key: "p/removed.txt", Path: "removed.txt", Local: removed, Params: params()}, "no such file"},
+		{"no params", PlanAction{Action: "new", Key: "p/same.txt", Path: "same.txt", Local: same}, "without params"},
+		{"sse-c without key", PlanAction{Action: "new", Key: "p/same.txt", Path: "same.txt", Local: same, Params: ssec}, "a key is required"},
+		{"encrypt without key", PlanAction{Action: "new", Key: "p/same.txt", Path: "same.txt", Local: same, Params: params(), Encrypt: true}, "an encryption key is required"},
+	}
+	s := New(nil)
+	p := &Plan{Source: dir}
+	for _, tt := range tests {
+		in, err := s.planInput(p, "bucket", tt.action)
+		if tt.err != "" {
+			if err == nil || !strings.Contains(err.Error(), tt.err) {
+				t.Errorf("%s: err = %v, want %q", tt.name, err, tt.err)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%s: %v", tt.name, err)
+			continue
+		}
+		if aws.StringValue(in.Params.Bucket) != "bucket" || aws.StringValue(in.Params.Key) != tt.action.Key {
+			t.Errorf("%s: uploads to %s/%s", tt.name, aws.StringValue(in.Params.Bucket), aws.StringValue(in.Params.Key))
+		}
+		if in.Exists || in.MetadataOnly {
+			t.Errorf("%s: Exists = %v, MetadataOnly = %v", tt.name, in.Exists, in.MetadataOnly)
+		}
+	}
+}
+
+func TestApplyChecksUnchanged(t *testing.T) {
+	dir, err := ioutil.TempDir("", "s3sync")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "a.txt")
+	if err := ioutil.WriteFile(path, []byte("abc"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	s, stop := newTestS3(t, "bucket", map[string]testObject{"p/a.txt": {Body: []byte("abc")}})
+	defer stop()
+	p, err := s.Plan(dir, "s3://bucket/p/", 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(p.Actions) != 1 || p.Actions[0].Action != "unchanged" {
+		t.Fatalf("plan = %+v, want a.txt unchanged", p.Actions)
+	}
+	s.DryRun = false
+	if err := s.Apply(p, 1); err != nil {
+		t.Errorf("Apply of an unchanged tree: %v", err)
+	}
+
+	mtime := time.Unix(1500000000, 0)
+	if err := os.Chtimes(path, mtime, mtime); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.Apply(p, 1); err == nil || !strings.Contains(err.Error(), "changed since the plan") {
+		t.Errorf("Apply after a.txt changed: %v, want it refused", err)
+	}
+}
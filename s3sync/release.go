@@ -0,0 +1,361 @@
+package s3sync
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/aws/aws-sdk-go/service/s3"
+)
+
+// Releases are stored below releasesDir of the target, and the id of the
+// current one in its currentPointer object. releasesDir/<id>releaseDone
+// marks a release whose files were all uploaded.
+const (
+	releasesDir    = "releases/"
+	releaseDone    = ".done"
+	currentPointer = "current"
+)
+
+// timeIDFormat formats the time a release, snapshot or manifest was made as
+// its id, so that ids sort in the order they were made.
+const timeIDFormat = "20060102T150405Z"
+
+// NewTimeID returns an id for a release or manifest made now.
+func NewTimeID() string {
+	return time.Now().UTC().Format(timeIDFormat)
+}
+
+func validID(id string) error {
+	if id == "" || id == "." || id == ".." || strings.Contains(id, "/") {
+		return fmt.Errorf("invalid id %q", id)
+	}
+	return nil
+}
+
+// A release is the set of objects below releasesDir/<ID>/, and its marker
+// if Done.
+type release struct {
+	ID       string
+	Modified time.Time
+	Done     bool
+	Objects  []*s3.ObjectIdentifier
+}
+
+type byModified []*release
+
+func (b byModified) Len() int      { return len(b) }
+func (b byModified) Swap(i, j int) { b[i], b[j] = b[j], b[i] }
+func (b byModified) Less(i, j int) bool {
+	if !b[i].Modified.Equal(b[j].Modified) {
+		return b[i].Modified.Before(b[j].Modified)
+	}
+	return b[i].ID < b[j].ID
+}
+
+// Release syncs source into a new release id below target and, once every
+// file has been uploaded, marks it done and makes it the current release.
+// Files that did not change since the current release are copied from it
+// instead of uploaded. Afterwards releases that were never marked done, and
+// all but the KeepReleases newest ones, are deleted. Releasing an id that
+// failed before resumes it.
+func (s *S3Sync) Release(source, target, id string, workers int) error {
+	if !isLocalPath(source) || !isS3Path(target) {
+		return errors.New("Releases can only be made from a local directory to S3")
+	}
+	if err := validID(id); err != nil {
+		return err
+	}
+	s3url, err := parseS3Path(target)
+	if err != nil {
+		return err
+	}
+	bucket, base := s3url.Host, cleanS3Path(s3url.Path)
+
+	s3Svc, err := s.client()
+	if err != nil {
+		return err
+	}
+	current, err := s.readPointer(s3Svc, bucket, base)
+	if err != nil {
+		return err
+	}
+	releases, err := s.releases(bucket, base)
+	if err != nil {
+		return err
+	}
+	for _, r := range releases {
+		if r.ID == id && r.Done {
+			return fmt.Errorf("release %s already exists", id)
+		}
+	}
+
+	prefix := base + releasesDir + id + "/"
+	if current != "" {
+		previous := base + releasesDir + current + "/"
+		index, err := s.bucketIndex(bucket, previous)
+		if err != nil {
+			return err
+		}
+		s.copyIndex = make(S3KeyMap, len(index))
+		for key, o := range index {
+			s.copyIndex[prefix+strings.TrimPrefix(key, previous)] = o
+		}
+		log.Printf("RELEASE: %s, copying unchanged files from %s", id, current)
+	}
+
+	failed := s.Summary().Failed
+	if err := s.Sync(source, "s3://"+bucket+"/"+prefix, workers); err != nil {
+		return err
+	}
+	if n := s.Summary().Failed - failed; n > 0 {
+		return fmt.Errorf("release %s not made current, %d files failed", id, n)
+	}
+	if err := s.writeText(s3Svc, bucket, base+releasesDir+id+releaseDone, id, "done"); err != nil {
+		return err
+	}
+	if err := s.writePointer(s3Svc, bucket, base, id); err != nil {
+		return err
+	}
+
+	incomplete, old := pruned(releases, current, id, s.KeepReleases)
+	for _, r := range incomplete {
+		log.Println("PRUNE INCOMPLETE:", r.ID)
+		s.deleteKeys(s3Svc, bucket, r.Objects)
+	}
+	for _, r := range old {
+		log.Println("PRUNE:", r.ID)
+		s.deleteKeys(s3Svc, bucket, r.Objects)
+	}
+	return nil
+}
+
+// pruned returns the releases, other than the new release id, that were
+// never marked done, and the done ones that are not among the keep newest
+// once id is counted. previous, the release that was current before id, is
+// counted as done even without a marker.
+func pruned(releases []*release, previous, id string, keep int) (incomplete, old []*release) {
+	var done []*release
+	for _, r := range releases {
+		switch {
+		case r.ID == id:
+		case r.Done || r.ID == previous:
+			done = append(done, r)
+		default:
+			incomplete = append(incomplete, r)
+		}
+	}
+	if keep > 0 && len(done) >= keep {
+		// The new release takes one of the places.
+		sort.Sort(sort.Reverse(byModified(done)))
+		old = done[keep-1:]
+	}
+	return incomplete, old
+}
+
+// Rollback makes the existing release id below target the current one, if
+// it was marked done.
+func (s *S3Sync) Rollback(target, id string) error {
+	if err := validID(id); err != nil {
+		return err
+	}
+	s3url, err := parseS3Path(target)
+	if err != nil {
+		return err
+	}
+	bucket, base := s3url.Host, cleanS3Path(s3url.Path)
+
+	s3Svc, err := s.client()
+	if err != nil {
+		return err
+	}
+	_, err = s3Svc.HeadObject(&s3.HeadObjectInput{
+		Bucket: aws.String(bucket),
+		Key:    aws.String(base + releasesDir + id + releaseDone),
+	})
+	if reqErr, ok := err.(awserr.RequestFailure); ok && reqErr.StatusCode() == 404 {
+		return fmt.Errorf("no complete release %s in %s", id, target)
+	}
+	if err != nil {
+		return err
+	}
+	return s.writePointer(s3Svc, bucket, base, id)
+}
+
+// releases lists the releases below base.
+func (s *S3Sync) releases(bucket, base string) ([]*release, error) {
+	index, err := s.bucketIndex(bucket, base+releasesDir)
+	if err != nil {
+		return nil, err
+	}
+
+	byID := make(map[string]*release)
+	var releases []*release
+	for key, o := range index {
+		name := strings.TrimPrefix(key, base+releasesDir)
+		id := strings.SplitN(name, "/", 2)[0]
+		done := id == name && strings.HasSuffix(name, releaseDone)
+		if done {
+			id = strings.TrimSuffix(name, releaseDone)
+		}
+		r := byID[id]
+		if r == nil {
+			r = &release{ID: id}
+			byID[id] = r
+			releases = append(releases, r)
+		}
+		if o.LastModified != nil && o.LastModified.After(r.Modified) {
+			r.Modified = *o.LastModified
+		}
+		r.Done = r.Done || done
+		r.Objects = append(r.Objects, &s3.ObjectIdentifier{Key: o.Key})
+	}
+	return releases, nil
+}
+
+// readPointer returns the id of the current release below base, or "" if
+// there is none.
+func (s *S3Sync) readPointer(s3Svc *s3.S3, bucket, base string) (string, error) {
+	resp, err := s3Svc.GetObject(&s3.GetObjectInput{
+		Bucket: aws.String(bucket),
+		Key:    aws.String(base + currentPointer),
+	})
+	if reqErr, ok := err.(awserr.RequestFailure); ok && reqErr.StatusCode() == 404 {
+		return "", nil
+	}
+	if err != nil {
+		return "", err
+	}
+	defer resp.Body.Close()
+
+	data, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return "", err
+	}
+	return strings.TrimSpace(string(data)), nil
+}
+
+// writePointer makes id the current release below base.
+func (s *S3Sync) writePointer(s3Svc *s3.S3, bucket, base, id string) error {
+	key := base + currentPointer
+	if err := s.writeText(s3Svc, bucket, key, id, "current"); err != nil {
+		return err
+	}
+	log.Printf("CURRENT: %s -> %s", key, id)
+	return nil
+}
+
+// writeText writes id as the object key, or reports action in a dry run. The
+// object is never encrypted with SSE-C, so whatever serves the releases can
+// read it.
+func (s *S3Sync) writeText(s3Svc *s3.S3, bucket, key, id, action string) error {
+	if s.DryRun {
+		report(action, key+" -> "+id)
+		return nil
+	}
+
+	params := &s3.PutObjectInput{
+		Bucket:       aws.String(bucket),
+		Key:          aws.String(key),
+		Body:         bytes.NewReader([]byte(id + "\n")),
+		ContentType:  aws.String("text/plain"),
+		CacheControl: aws.String("no-cache"),
+	}
+	if s.SSE.Algorithm != "" {
+		params.ServerSideEncryption = aws.String(s.SSE.Algorithm)
+	}
+	if s.SSE.KMSKeyID != "" {
+		params.SSEKMSKeyId = aws.String(s.SSE.KMSKeyID)
+	}
+	if s.ACL != "" {
+		params.ACL = aws.String(s.ACL)
+	}
+	_, err := s3Svc.PutObject(params)
+	return err
+}
+
+// copyUnchanged copies in.CopyFrom to the key of in if it holds the current
+// content of the local file. It reports whether it copied or failed to;
+// otherwise in has to be uploaded.
+func (s *S3Sync) copyUnchanged(s3Svc *s3.S3, q *uploadQueue, in *localToS3Input) bool {
+	key := *in.Params.Key
+	head, err := s3Svc.HeadObject(&s3.HeadObjectInput{
+		Bucket:               in.Params.Bucket,
+		Key:                  aws.String(in.CopyFrom),
+		SSECustomerAlgorithm: in.Params.SSECustomerAlgorithm,
+		SSECustomerKey:       in.Params.SSECustomerKey,
+	})
+	match := false
+	if reqErr, ok := err.(awserr.RequestFailure); ok && reqErr.StatusCode() == 404 {
+		err = nil
+	} else if err == nil {
+		match, err = sameContent(in, head)
+	}
+	if err != nil {
+		log.Print(err)
+		s.uploadFailed(q, "copy", in, err)
+		return true
+	}
+	// Objects over 5 GB can not be copied, so they are uploaded instead.
+	if !match || aws.Int64Value(head.ContentLength) > maxCopySize {
+		in.CopyFrom = ""
+		return false
+	}
+
+	adoptOriginal(in.Params, head)
+	if v := metadataValue(head.Metadata, metaSHA256); v != "" && in.Encryption == nil {
+		in.SHA256 = v
+		in.Params.Metadata[metaSHA256] = aws.String(v)
+	}
+	if s.DryRun {
+		s.dryRun("copy", in)
+		return true
+	}
+
+	start := time.Now()
+	s.emit(Event{Event: EventStarted, Action: "copy", Key: key, Path: in.LocalPath})
+	params := copyParams(in.Params)
+	params.CopySource = aws.String(copySource(*in.Params.Bucket, in.CopyFrom))
+	if _, err := copyObject(s3Svc, params, in.Tags); err != nil {
+		log.Print(err)
+		s.uploadFailed(q, "copy", in, err)
+		return true
+	}
+	debug("Copied:", in.CopyFrom, key)
+	s.emit(Event{
+		Event:    EventCompleted,
+		Action:   "copy",
+		Key:      key,
+		Path:     in.LocalPath,
+		Duration: time.Since(start).Seconds(),
+	})
+	return true
+}
+
+// sameContent reports whether the object described by head holds the
+// current content of the local file of in, in the same encryption.
+// Encrypted objects only record a keyed hmac of their content.
+func sameContent(in *localToS3Input, head *s3.HeadObjectOutput) (bool, error) {
+	if encrypted := metadataValue(head.Metadata, metaCSEAlgorithm) != ""; encrypted != (in.Encryption != nil) {
+		return false, nil
+	}
+	if in.Encryption != nil {
+		return originalMatches(in.LocalPath, in.Info.Size(), head.Metadata, in.Encryption)
+	}
+	remote := metadataValue(head.Metadata, metaSHA256)
+	if remote == "" {
+		return false, nil
+	}
+	local, err := fileSHA256(in)
+	if err != nil {
+		return false, err
+	}
+	return local == remote, nil
+}
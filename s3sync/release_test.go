@@ -0,0 +1,204 @@
+package s3sync
+
+import (
+	"bytes"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/s3"
+)
+
+func testReleaseIDs(releases []*release) []string {
+	ids := []string{}
+	for _, r := range releases {
+		ids = append(ids, r.ID)
+	}
+	return ids
+}
+
+func TestPruned(t *testing.T) {
+	base := time.Date(2015, 8, 27, 10, 0, 0, 0, time.UTC)
+	at := func(id string, minutes int, done bool) *release {
+		return &release{ID: id, Modified: base.Add(time.Duration(minutes) * time.Minute), Done: done}
+	}
+
+	tests := []struct {
+		name       string
+		releases   []*release
+		previous   string
+		id         string
+		keep       int
+		incomplete []string
+		old        []string
+	}{
+		{
+			name:       "keep all",
+			releases:   []*release{at("a", 1, true), at("b", 2, true), at("new", 3, false)},
+			id:         "new",
+			incomplete: []string{},
+			old:        []string{},
+		},
+		{
+			name:       "oldest first to go",
+			releases:   []*release{at("c", 3, true), at("a", 1, true), at("b", 2, true), at("new", 4, false)},
+			id:         "new",
+			keep:       2,
+			incomplete: []string{},
+			old:        []string{"b", "a"},
+		},
+		{
+			name:       "new release takes a place",
+			releases:   []*release{at("a", 1, true), at("new", 2, false)},
+			id:         "new",
+			keep:       1,
+			incomplete: []string{},
+			old:        []string{"a"},
+		},
+		{
+			name:       "incomplete releases are not kept",
+			releases:   []*release{at("a", 1, true), at("failed", 2, false), at("b", 3, true), at("new", 4, false)},
+			id:         "new",
+			keep:       3,
+			incomplete: []string{"failed"},
+			old:        []string{},
+		},
+		{
+			name:       "previous release counts as done",
+			releases:   []*release{at("legacy", 1, false), at("a", 2, true), at("new", 3, false)},
+			previous:   "legacy",
+			id:         "new",
+			keep:       2,
+			incomplete: []string{},
+			old:        []string{"legacy"},
+		},
+		{
+			name:       "no releases",
+			releases:   []*release{},
+			id:         "new",
+			keep:       2,
+			incomplete: []string{},
+			old:        []string{},
+		},
+		{
+			name:       "fewer than keep",
+			releases:   []*release{at("a", 1, true), at("new", 2, false)},
+			id:         "new",
+			keep:       5,
+			incomplete: []string{},
+			old:        []string{},
+		},
+		{
+			name:       "new release not listed yet",
+			releases:   []*release{at("a", 1, true), at("b", 2, true)},
+			id:         "new",
+			keep:       2,
+			incomplete: []string{},
+			old:        []string{"a"},
+		},
+		{
+			name:       "keep only the new release",
+			releases:   []*release{at("a", 1, true), at("b", 2, true), at("new", 3, false)},
+			id:         "new",
+			keep:       1,
+			incomplete: []string{},
+			old:        []string{"b", "a"},
+		},
+		{
+			name:       "previous release that is done counts once",
+			releases:   []*release{at("a", 1, true), at("b", 2, true), at("new", 3, false)},
+			previous:   "b",
+			id:         "new",
+			keep:       2,
+			incomplete: []string{},
+			old:        []string{"a"},
+		},
+		{
+			name:       "same time sorts by id",
+			releases:   []*release{at("b", 1, true), at("a", 1, true), at("new", 2, false)},
+			id:         "new",
+			keep:       2,
+			incomplete: []string{},
+			old:        []string{"a"},
+		},
+	}
+	for _, tt := range tests {
+		incomplete, old := pruned(tt.releases, tt.previous, tt.id, tt.keep)
+		if got := testReleaseIDs(incomplete); !reflect.DeepEqual(got, tt.incomplete) {
+			t.Errorf("%s: incomplete = %q, want %q", tt.name, got, tt.incomplete)
+		}
+		if got := testReleaseIDs(old); !reflect.DeepEqual(got, tt.old) {
+			t.Errorf("%s: old = %q, want %q", tt.name, got, tt.old)
+		}
+	}
+}
+
+func TestValidID(t *testing.T) {
+	for id, ok := range map[string]bool{
+		"20150827T100000Z": true,
+		"v1.2.3":           true,
+		"":                 false,
+		".":                false,
+		"..":               false,
+		"a/b":              false,
+		"../etc":           false,
+	} {
+		if err := validID(id); (err == nil) != ok {
+			t.Errorf("validID(%q) = %v, want ok %v", id, err, ok)
+		}
+	}
+}
+
+func TestSameContent(t *testing.T) {
+	dir, err := ioutil.TempDir("", "s3sync")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "a.txt")
+	if err := ioutil.WriteFile(path, []byte("abc"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	info, err := os.Lstat(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	sum := sha256Hex(strings.NewReader("abc"))
+	e := &ClientEncryption{MasterKey: bytes.Repeat([]byte{1}, 32)}
+	mac, err := e.macFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	plain := map[string]*string{metaSHA256: aws.String(sum)}
+	encrypted := map[string]*string{
+		metaOriginalSize: aws.String("3"),
+		metaCSEAlgorithm: aws.String(cseAlgorithm),
+		metaOriginalMAC:  aws.String(mac),
+	}
+
+	tests := []struct {
+		name     string
+		e        *ClientEncryption
+		metadata map[string]*string
+		want     bool
+	}{
+		{"plain", nil, plain, true},
+		{"plain without sha256", nil, map[string]*string{}, false},
+		{"plain, other content", nil, map[string]*string{metaSHA256: aws.String(sha256Hex(strings.NewReader("abd")))}, false},
+		{"encrypted", e, encrypted, true},
+		{"encrypted object, plain upload", nil, encrypted, false},
+		{"plain object, encrypted upload", e, plain, false},
+	}
+	for _, tt := range tests {
+		in := &localToS3Input{LocalPath: path, Info: info, Encryption: tt.e}
+		got, err := sameContent(in, &s3.HeadObjectOutput{Metadata: tt.metadata})
+		if err != nil || got != tt.want {
+			t.Errorf("%s: sameContent = %v, %v, want %v", tt.name, got, err, tt.want)
+		}
+	}
+}
@@ -0,0 +1,191 @@
+package s3sync
+
+import (
+	"bufio"
+	"log"
+	"math/rand"
+	"net"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws/awserr"
+)
+
+// Defaults for retrying failed uploads.
+const (
+	DefaultRetries    = 3
+	DefaultRetryDelay = time.Second
+	maxRetryDelay     = 5 * time.Minute
+)
+
+// uploadQueue feeds files to the upload workers. Failed uploads wait on a
+// timer, not in a worker, until they are retried.
+type uploadQueue struct {
+	files   chan *localToS3Input
+	stop    <-chan struct{}
+	pending sync.WaitGroup
+	workers sync.WaitGroup
+
+	// hold keeps added files in held until release.
+	hold bool
+	held []*localToS3Input
+
+	// dropped is called for each file that is not uploaded because stop
+	// was closed.
+	dropped func(in *localToS3Input)
+}
+
+// add queues in for upload.
+func (q *uploadQueue) add(in *localToS3Input) {
+	if q.hold {
+		q.held = append(q.held, in)
+		return
+	}
+	q.pending.Add(1)
+	q.files <- in
+}
+
+// release queues the held files.
+func (q *uploadQueue) release() {
+	held := q.held
+	q.hold, q.held = false, nil
+	for _, in := range held {
+		q.add(in)
+	}
+}
+
+// retry queues in again after delay.
+func (q *uploadQueue) retry(in *localToS3Input, delay time.Duration) {
+	q.pending.Add(1)
+	go func() {
+		select {
+		case <-time.After(delay):
+			q.files <- in
+		case <-q.stop:
+			q.dropped(in)
+			q.pending.Done()
+		}
+	}()
+}
+
+// drain waits for every queued and retried upload to finish.
+func (q *uploadQueue) drain() {
+	q.pending.Wait()
+}
+
+// wait drains q and stops the workers.
+func (q *uploadQueue) wait() {
+	q.drain()
+	close(q.files)
+	q.workers.Wait()
+}
+
+// retryable reports whether err may go away if the request is tried again.
+func retryable(err error) bool {
+	if reqErr, ok := err.(awserr.RequestFailure); ok {
+		code := reqErr.StatusCode()
+		if code >= 500 || code == 429 {
+			return true
+		}
+	}
+	if awsErr, ok := err.(awserr.Error); ok {
+		switch awsErr.Code() {
+		case "RequestError", "RequestTimeout", "SlowDown", "Throttling",
+			"ThrottlingException", "InternalError", "ServiceUnavailable",
+			"BadDigest", "VerifyMismatch", "UnstableFile":
+			return true
+		}
+		if _, ok := awsErr.OrigErr().(net.Error); ok {
+			return true
+		}
+		return false
+	}
+	_, ok := err.(net.Error)
+	return ok
+}
+
+// backoff returns the delay before retry number attempt, doubling base each
+// time with up to half of it taken off at random.
+func backoff(base time.Duration, attempt int) time.Duration {
+	if base <= 0 {
+		base = DefaultRetryDelay
+	}
+	d := base << uint(attempt)
+	if d < base || d > maxRetryDelay {
+		d = maxRetryDelay
+	}
+	return d - time.Duration(rand.Int63n(int64(d)/2+1))
+}
+
+// uploadFailed retries in later if err is retryable and attempts are left,
+// otherwise it reports the failure.
+func (s *S3Sync) uploadFailed(q *uploadQueue, action string, in *localToS3Input, err error) {
+	if q != nil && in.Attempt < s.Retries && retryable(err) && s.aborted() == nil {
+		delay := backoff(s.RetryDelay, in.Attempt)
+		in.Attempt++
+		log.Printf("RETRY %d/%d in %s: %s %s", in.Attempt, s.Retries, delay, in.LocalPath, err)
+		q.retry(in, delay)
+		return
+	}
+
+	s.emitFailed(action, *in.Params.Key, in.LocalPath, err)
+	s.addFailed(in)
+}
+
+// uploadDropped reports in as skipped after an abort, and lists it in
+// FailedList so that it is tried again.
+func (s *S3Sync) uploadDropped(in *localToS3Input) {
+	s.emit(Event{Event: EventSkipped, Key: *in.Params.Key, Path: in.LocalPath, Reason: "aborted"})
+	s.addFailed(in)
+}
+
+// addFailed adds in to the paths written to FailedList.
+func (s *S3Sync) addFailed(in *localToS3Input) {
+	s.failedMu.Lock()
+	s.failed = append(s.failed, in.RelPath)
+	s.failedMu.Unlock()
+}
+
+// writeFailedList writes the paths of the files that failed, relative to the
+// source, to FailedList.
+func (s *S3Sync) writeFailedList() error {
+	s.failedMu.Lock()
+	failed := append([]string(nil), s.failed...)
+	s.failedMu.Unlock()
+	sort.Strings(failed)
+
+	f, err := os.Create(s.FailedList)
+	if err != nil {
+		return err
+	}
+	w := bufio.NewWriter(f)
+	for _, path := range failed {
+		w.WriteString(path + "\n")
+	}
+	if err := w.Flush(); err != nil {
+		f.Close()
+		return err
+	}
+	return f.Close()
+}
+
+// LoadFileList reads a list of paths, one per line, such as a failed list.
+func LoadFileList(path string) ([]string, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	var paths []string
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		if line := strings.TrimSpace(scanner.Text()); line != "" {
+			paths = append(paths, line)
+		}
+	}
+	return paths, scanner.Err()
+}
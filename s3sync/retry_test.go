@@ -0,0 +1,76 @@
+package s3sync
+
+import (
+	"errors"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws/awserr"
+)
+
+func TestRetryable(t *testing.T) {
+	timeout := &net.OpError{Op: "dial", Err: errors.New("i/o timeout")}
+	tests := []struct {
+		name string
+		err  error
+		want bool
+	}{
+		{"500", awserr.NewRequestFailure(awserr.New("InternalError", "", nil), 500, ""), true},
+		{"503 with any code", awserr.NewRequestFailure(awserr.New("Unknown", "", nil), 503, ""), true},
+		{"429", awserr.NewRequestFailure(awserr.New("TooManyRequests", "", nil), 429, ""), true},
+		{"403", awserr.NewRequestFailure(awserr.New("AccessDenied", "", nil), 403, ""), false},
+		{"404", awserr.NewRequestFailure(awserr.New("NoSuchBucket", "", nil), 404, ""), false},
+		{"throttled", awserr.New("SlowDown", "", nil), true},
+		{"bad digest", awserr.New("BadDigest", "", nil), true},
+		{"unstable file", awserr.New("UnstableFile", "", nil), true},
+		{"wrapped network error", awserr.New("SerializationError", "", timeout), true},
+		{"other aws error", awserr.New("InvalidArgument", "", nil), false},
+		{"network error", timeout, true},
+		{"local error", errors.New("permission denied"), false},
+	}
+	for _, tt := range tests {
+		if got := retryable(tt.err); got != tt.want {
+			t.Errorf("%s: retryable = %v, want %v", tt.name, got, tt.want)
+		}
+	}
+}
+
+func TestBackoff(t *testing.T) {
+	tests := []struct {
+		base    time.Duration
+		attempt int
+		max     time.Duration
+	}{
+		{time.Second, 0, time.Second},
+		{time.Second, 3, 8 * time.Second},
+		{0, 1, 2 * DefaultRetryDelay},
+		{time.Second, 20, maxRetryDelay},
+		{time.Second, 100, maxRetryDelay},
+	}
+	for _, tt := range tests {
+		for i := 0; i < 100; i++ {
+			d := backoff(tt.base, tt.attempt)
+			if d < tt.max/2 || d > tt.max {
+				t.Errorf("backoff(%s, %d) = %s, want between %s and %s", tt.base, tt.attempt, d, tt.max/2, tt.max)
+				break
+			}
+		}
+	}
+}
+
+func TestRetryDroppedOnStop(t *testing.T) {
+	stop := make(chan struct{})
+	var dropped []string
+	q := &uploadQueue{
+		files:   make(chan *localToS3Input, 1),
+		stop:    stop,
+		dropped: func(in *localToS3Input) { dropped = append(dropped, in.RelPath) },
+	}
+	q.retry(&localToS3Input{RelPath: "a.txt"}, time.Hour)
+	close(stop)
+	q.drain()
+	if len(dropped) != 1 || dropped[0] != "a.txt" {
+		t.Errorf("dropped = %q, want [a.txt]", dropped)
+	}
+}
@@ -0,0 +1,223 @@
+package s3sync
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/s3"
+)
+
+// Rule sets headers, user metadata, storage class, ACL and tags on every file
+// whose path, relative to the sync source, matches Pattern. Patterns without
+// a / are matched against the file name only.
+type Rule struct {
+	Pattern      string            `json:"pattern"`
+	Headers      map[string]string `json:"headers"`
+	Metadata     map[string]string `json:"metadata"`
+	StorageClass string            `json:"storage_class"`
+	ACL          string            `json:"acl"`
+	Tags         map[string]string `json:"tags"`
+}
+
+// LoadRules reads a JSON list of rules. Rules are applied in file order, so
+// later rules override earlier ones.
+func LoadRules(path string) ([]Rule, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	var rules []Rule
+	if err := json.NewDecoder(f).Decode(&rules); err != nil {
+		return nil, fmt.Errorf("%s: %s", path, err)
+	}
+
+	for i := range rules {
+		if err := rules[i].validate(); err != nil {
+			return nil, fmt.Errorf("%s: rule %d: %s", path, i, err)
+		}
+	}
+	return rules, nil
+}
+
+func (r *Rule) validate() error {
+	if r.Pattern == "" {
+		return fmt.Errorf("missing pattern")
+	}
+	if _, err := filepath.Match(r.Pattern, ""); err != nil {
+		return fmt.Errorf("%s: %s", r.Pattern, err)
+	}
+	return r.apply(&s3.PutObjectInput{}, make(map[string]string))
+}
+
+// Match reports whether the rule applies to relPath.
+func (r *Rule) Match(relPath string) bool {
+	return matchPattern(r.Pattern, relPath)
+}
+
+// matchPattern matches pattern against relPath, or only against its file name
+// when pattern contains no /.
+func matchPattern(pattern, relPath string) bool {
+	name := relPath
+	if !strings.Contains(pattern, "/") {
+		name = filepath.Base(relPath)
+	}
+	match, _ := filepath.Match(pattern, name)
+	return match
+}
+
+func (r *Rule) apply(params *s3.PutObjectInput, tags map[string]string) error {
+	for name, value := range r.Headers {
+		switch http.CanonicalHeaderKey(name) {
+		case "Cache-Control":
+			params.CacheControl = aws.String(value)
+		case "Content-Disposition":
+			params.ContentDisposition = aws.String(value)
+		case "Content-Encoding":
+			params.ContentEncoding = aws.String(value)
+		case "Content-Language":
+			params.ContentLanguage = aws.String(value)
+		case "Content-Type":
+			params.ContentType = aws.String(value)
+		case "Expires":
+			t, err := http.ParseTime(value)
+			if err != nil {
+				return fmt.Errorf("Expires: %s", err)
+			}
+			params.Expires = aws.Time(t)
+		case "X-Amz-Website-Redirect-Location":
+			params.WebsiteRedirectLocation = aws.String(value)
+		default:
+			return fmt.Errorf("unsupported header %q", name)
+		}
+	}
+
+	if len(r.Metadata) > 0 && params.Metadata == nil {
+		params.Metadata = make(map[string]*string)
+	}
+	for k, v := range r.Metadata {
+		params.Metadata[k] = aws.String(v)
+	}
+
+	if r.StorageClass != "" {
+		params.StorageClass = aws.String(r.StorageClass)
+	}
+	if r.ACL != "" {
+		params.ACL = aws.String(r.ACL)
+	}
+	for k, v := range r.Tags {
+		tags[k] = v
+	}
+	return nil
+}
+
+// applyRules applies every rule matching relPath to params and tags.
+func applyRules(rules []Rule, relPath string, params *s3.PutObjectInput, tags map[string]string) {
+	for i := range rules {
+		if !rules[i].Match(relPath) {
+			continue
+		}
+		if err := rules[i].apply(params, tags); err != nil {
+			debug("applyRules", rules[i].Pattern, err)
+		}
+	}
+}
+
+// rulesStateName is the object below the target prefix that holds the rules
+// of the last sync that completed without failures.
+const rulesStateName = ".s3sync-rules.json"
+
+type rulesState struct {
+	Rules []Rule `json:"rules"`
+}
+
+// loadRulesState reads the rules the objects below prefix were last synced
+// with, if they are known.
+func (s *S3Sync) loadRulesState(s3Svc *s3.S3, bucket, prefix string, bucketIndex S3KeyMap) error {
+	s.prevRules, s.prevRulesKnown = nil, false
+	if !bucketIndex.Exists(prefix + rulesStateName) {
+		return nil
+	}
+	var state rulesState
+	if err := s.getJSON(s3Svc, bucket, prefix+rulesStateName, &state); err != nil {
+		return err
+	}
+	s.prevRules, s.prevRulesKnown = state.Rules, true
+	return nil
+}
+
+// saveRulesState records Rules as the rules the objects below prefix were
+// synced with, unless they did not change or a file failed since failed.
+func (s *S3Sync) saveRulesState(s3Svc *s3.S3, bucket, prefix string, failed int64) error {
+	if s.DryRun || s.FilesFrom != nil || s.Summary().Failed > failed {
+		return nil
+	}
+	if len(s.Rules) == 0 && !s.prevRulesKnown {
+		return nil
+	}
+	current, _ := json.Marshal(s.Rules)
+	previous, _ := json.Marshal(s.prevRules)
+	if s.prevRulesKnown && bytes.Equal(current, previous) {
+		return nil
+	}
+	return s.putJSON(s3Svc, bucket, prefix+rulesStateName, rulesState{Rules: s.Rules})
+}
+
+// rulesChanged reports whether the rules matching relPath may have changed
+// since its object was synced, so its headers have to be compared. When the
+// previous rules are unknown, every file is compared if there are rules.
+func (s *S3Sync) rulesChanged(relPath string) bool {
+	if !s.prevRulesKnown {
+		return len(s.Rules) > 0
+	}
+	return !bytes.Equal(matchingRules(s.Rules, relPath), matchingRules(s.prevRules, relPath))
+}
+
+// matchingRules returns the JSON of the rules that match relPath.
+func matchingRules(rules []Rule, relPath string) []byte {
+	var matching []Rule
+	for i := range rules {
+		if rules[i].Match(relPath) {
+			matching = append(matching, rules[i])
+		}
+	}
+	data, _ := json.Marshal(matching)
+	return data
+}
+
+// headersEqual reports whether the headers an object was stored with match
+// the ones that would be sent for params. The storage class is only compared
+// if params sets one, so lifecycle transitions are left alone, and the ACL is
+// not compared as HEAD does not return it.
+func headersEqual(params *s3.PutObjectInput, head *s3.HeadObjectOutput) bool {
+	if !sseEqual(params, head) {
+		return false
+	}
+	// HEAD leaves out the storage class of STANDARD objects.
+	if params.StorageClass != nil &&
+		*params.StorageClass != aws.StringValue(head.StorageClass) &&
+		!(*params.StorageClass == s3.StorageClassStandard && head.StorageClass == nil) {
+		return false
+	}
+	if aws.StringValue(params.CacheControl) != aws.StringValue(head.CacheControl) ||
+		aws.StringValue(params.ContentDisposition) != aws.StringValue(head.ContentDisposition) ||
+		aws.StringValue(params.ContentEncoding) != aws.StringValue(head.ContentEncoding) ||
+		aws.StringValue(params.ContentLanguage) != aws.StringValue(head.ContentLanguage) ||
+		aws.StringValue(params.ContentType) != aws.StringValue(head.ContentType) ||
+		aws.StringValue(params.WebsiteRedirectLocation) != aws.StringValue(head.WebsiteRedirectLocation) {
+		return false
+	}
+
+	if params.Expires == nil || head.Expires == nil {
+		return params.Expires == nil && head.Expires == nil
+	}
+	expires, err := http.ParseTime(*head.Expires)
+	return err == nil && expires.Equal(*params.Expires)
+}
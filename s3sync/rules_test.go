@@ -0,0 +1,33 @@
+package s3sync
+
+import "testing"
+
+func TestRulesChanged(t *testing.T) {
+	html := Rule{Pattern: "*.html", Headers: map[string]string{"Cache-Control": "no-cache"}}
+	html60 := Rule{Pattern: "*.html", Headers: map[string]string{"Cache-Control": "max-age=60"}}
+	css := Rule{Pattern: "*.css", Headers: map[string]string{"Cache-Control": "max-age=3600"}}
+
+	tests := []struct {
+		name     string
+		rules    []Rule
+		previous []Rule
+		known    bool
+		relPath  string
+		want     bool
+	}{
+		{"no rules", nil, nil, false, "a.html", false},
+		{"unknown", []Rule{html}, nil, false, "a.css", true},
+		{"same rules", []Rule{html, css}, []Rule{html, css}, true, "a.html", false},
+		{"changed rule", []Rule{html60, css}, []Rule{html, css}, true, "a.html", true},
+		{"other rule changed", []Rule{html60, css}, []Rule{html, css}, true, "a.css", false},
+		{"rule added", []Rule{html, css}, []Rule{html}, true, "dir/a.css", true},
+		{"rules dropped", nil, []Rule{html}, true, "a.html", true},
+		{"dropped rule did not match", nil, []Rule{html}, true, "a.css", false},
+	}
+	for _, tt := range tests {
+		s := &S3Sync{Rules: tt.rules, prevRules: tt.previous, prevRulesKnown: tt.known}
+		if got := s.rulesChanged(tt.relPath); got != tt.want {
+			t.Errorf("%s: rulesChanged(%q) = %v, want %v", tt.name, tt.relPath, got, tt.want)
+		}
+	}
+}
@@ -3,20 +3,22 @@ package s3sync
 import (
 	"bytes"
 	"crypto/md5"
+	"crypto/sha256"
 	"errors"
 	"fmt"
 	"io"
+	"io/ioutil"
 	"log"
-	"mime"
 	"net/url"
 	"os"
 	"path/filepath"
 	"strings"
 	"sync"
-	"syscall"
 	"time"
 
 	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/aws/aws-sdk-go/aws/credentials"
 	"github.com/aws/aws-sdk-go/service/s3"
 )
 
@@ -46,27 +48,137 @@ func New(awsConfig *aws.Config) *S3Sync {
 		AWSConfig:          awsConfig,
 		ExcludeDirectories: make(map[string]bool),
 		ExcludePatterns:    make([]string, 0),
+		Compression:        CompressionGzip,
+		Tags:               make(map[string]string),
 	}
 }
 
 func (s *S3Sync) Sync(source, target string, workers int) error {
+	if err := s.SSE.Validate(); err != nil {
+		return err
+	}
+	if len(s.CompressPatterns) > 0 {
+		if err := validCompression(s.Compression); err != nil {
+			return err
+		}
+	}
+
 	if isLocalPath(source) && isS3Path(target) {
 		s3url, err := parseS3Path(target)
 		if err != nil {
 			return err
 		}
 
+		defer s.emitSummary()
 		return s.syncLocalToS3(source, s3url.Host, s3url.Path, workers)
 	}
 
+	if isS3Path(source) && !isS3Path(target) {
+		s3url, err := parseS3Path(source)
+		if err != nil {
+			return err
+		}
+
+		if s.Watch {
+			return errors.New("Watch needs a local source")
+		}
+
+		defer s.emitSummary()
+		return s.syncS3ToLocal(s3url.Host, s3url.Path, target, workers)
+	}
+
 	return errors.New("Operation not supported")
 }
 
 type S3Sync struct {
 	AWSConfig          *aws.Config
 	CopySymlinks       bool
+	UpdateMetadata     bool
+	Rules              []Rule
+	SniffContentType   bool
+	CharsetUTF8        bool
+	CompressPatterns   []string
+	Compression        string
+	SSE                SSE
+	Encryption         *ClientEncryption
+	StorageClass       string
+	ACL                string
+	Tags               map[string]string
+	DryRun             bool
+	VerifyUploads      bool
+	Manifest           string
+	Delete             bool
 	ExcludePatterns    []string
 	ExcludeDirectories map[string]bool
+
+	// UnstableRetries is how many times a file that changes while it is
+	// uploaded is uploaded again. Files up to SnapshotSize bytes are read
+	// into memory before uploading.
+	UnstableRetries int
+	SnapshotSize    int64
+
+	// Retries is how many times a failed upload is retried, starting
+	// RetryDelay later and backing off exponentially. The files that still
+	// fail are written to FailedList. FilesFrom limits a sync to the listed
+	// files, relative to the source.
+	Retries    int
+	RetryDelay time.Duration
+	FailedList string
+	FilesFrom  []string
+
+	// MaxErrors and MaxErrorRate, a fraction of finished files, abort the
+	// sync once that many files failed.
+	MaxErrors    int
+	MaxErrorRate float64
+
+	// MaxChanges and MaxChangesPercent, of the existing objects, limit how
+	// many objects a sync may overwrite or delete unless Force is set.
+	MaxChanges        int
+	MaxChangesPercent float64
+	Force             bool
+
+	// KeepReleases is how many releases Release keeps, 0 for all.
+	KeepReleases int
+
+	// Phases are lists of patterns uploaded one after another, after the
+	// files that match none of them, and before orphans are deleted.
+	Phases [][]string
+
+	// CredentialsProvider overrides the SDK's default credential chain.
+	CredentialsProvider credentials.Provider
+
+	// Metrics, if set, collects counters of the sync.
+	Metrics *Metrics
+
+	// Watch keeps a local to S3 sync running after the initial pass,
+	// uploading files as they change. WatchDelete also deletes the keys of
+	// removed files and WatchDelay is how long to wait for changes to settle.
+	Watch       bool
+	WatchDelete bool
+	WatchDelay  time.Duration
+
+	clientOnce sync.Once
+	s3Svc      *s3.S3
+	clientErr  error
+
+	events  *eventLog
+	summary Summary
+	plan    *Plan
+
+	// copyIndex maps keys to objects that unchanged files are copied from.
+	copyIndex S3KeyMap
+
+	// prevRules are the rules of the last sync, if prevRulesKnown.
+	prevRules      []Rule
+	prevRulesKnown bool
+
+	failedMu sync.Mutex
+	failed   []string
+
+	abortInit sync.Once
+	abortOnce sync.Once
+	abortCh   chan struct{}
+	abortErr  error
 }
 
 func cleanS3Path(path string) string {
@@ -77,6 +189,12 @@ func cleanS3Path(path string) string {
 	return path
 }
 
+// excludedDir reports whether the directory at path is not synced, because
+// either its path or its name is in ExcludeDirectories.
+func (s *S3Sync) excludedDir(path string) bool {
+	return s.ExcludeDirectories[path] || s.ExcludeDirectories[filepath.Base(path)]
+}
+
 func (s *S3Sync) excludeFile(path string) bool {
 	for _, pattern := range s.ExcludePatterns {
 		match, err := filepath.Match(pattern, path)
@@ -85,6 +203,7 @@ func (s *S3Sync) excludeFile(path string) bool {
 			continue
 		}
 		if match {
+			s.emit(Event{Event: EventSkipped, Path: path, Reason: "excluded"})
 			return true
 		}
 
@@ -95,94 +214,393 @@ func (s *S3Sync) excludeFile(path string) bool {
 func (s *S3Sync) syncLocalToS3(source, bucket, prefix string, workers int) error {
 	prefix = cleanS3Path(prefix)
 
+	s3Svc, err := s.client()
+	if err != nil {
+		return err
+	}
+
+	if s.Watch {
+		q := s.startUploaders(s3Svc, workers)
+		err = s.watch(s3Svc, source, bucket, prefix, q)
+		q.wait()
+		return err
+	}
+
 	bucketIndex, err := s.bucketIndex(bucket, prefix)
 	if err != nil {
 		return err
 	}
+	if err := s.loadRulesState(s3Svc, bucket, prefix, bucketIndex); err != nil {
+		return err
+	}
 
-	fileChan := make(chan *localToS3Input, workers*1000)
-	wg := new(sync.WaitGroup)
-	wg.Add(workers)
-	for i := 0; i < workers; i++ {
-		go func() {
-			defer wg.Done()
-			s3Svc := s3.New(s.AWSConfig)
-			for f := range fileChan {
-				start := time.Now()
-				log.Println("START:", f.LocalPath, *f.Params.Key)
+	if s.Manifest != "" {
+		if _, err := manifestName(s.Manifest); err != nil {
+			return err
+		}
+		// Its sha256 sums would tell which plaintext each object holds.
+		if s.Encryption != nil {
+			return errors.New("Manifests cannot be written for files encrypted client side")
+		}
+	}
+	failed := s.Summary().Failed
+
+	q := s.startUploaders(s3Svc, workers)
+	q.hold = s.guarded() || len(s.Phases) > 0
+	var seen map[string]*localToS3Input
+	if s.FilesFrom != nil {
+		seen = s.queueList(source, bucket, prefix, bucketIndex, q)
+	} else {
+		seen = s.walkLocal(source, source, bucket, prefix, bucketIndex, q)
+	}
 
-				err := localToS3(s3Svc, f)
-				if err != nil {
-					log.Print(err)
-				}
+	var orphans []*s3.ObjectIdentifier
+	if s.Delete && s.FilesFrom == nil && s.aborted() == nil {
+		orphans = s.orphans(source, prefix, bucketIndex, seen)
+		s.plan.addDeletes(prefix, orphans, bucketIndex)
+	}
+	if s.guarded() {
+		if err := s.checkPlan(len(bucketIndex), q.held, len(orphans)); err != nil {
+			q.held = nil
+			q.wait()
+			return err
+		}
+	}
+	phaseErr := s.release(q)
+	q.wait()
 
-				log.Printf("DONE (%s): %s %s", time.Since(start), f.LocalPath, *f.Params.Key)
-			}
-		}()
+	if s.FailedList != "" {
+		if err := s.writeFailedList(); err != nil {
+			return err
+		}
+	}
+	if err := s.aborted(); err != nil {
+		return err
+	}
+	if phaseErr != nil {
+		return phaseErr
 	}
 
-	filterPath := func(path string, info os.FileInfo) bool {
-		if s.CopySymlinks && info.Mode()&os.ModeSymlink != 0 {
-			return s.excludeFile(path)
+	s.deleteKeys(s3Svc, bucket, orphans)
+	if s.DryRun && !s.Delete && s.FilesFrom == nil {
+		for key := range bucketIndex {
+			if _, ok := seen[key]; !ok && key != prefix+rulesStateName {
+				report("extra", key)
+			}
 		}
-		if info.Mode().IsRegular() {
-			return s.excludeFile(path)
+	}
+	if err := s.saveRulesState(s3Svc, bucket, prefix, failed); err != nil {
+		return err
+	}
+
+	if s.Manifest != "" {
+		if n := s.Summary().Failed - failed; n > 0 {
+			return fmt.Errorf("manifest not written, %d files failed", n)
 		}
+		return s.writeManifest(s3Svc, bucket, prefix, seen)
+	}
+	return nil
+}
+
+// startUploaders starts workers that upload everything added to the
+// returned queue.
+func (s *S3Sync) startUploaders(s3Svc *s3.S3, workers int) *uploadQueue {
+	q := &uploadQueue{
+		files:   make(chan *localToS3Input, workers*1000),
+		stop:    s.abortChan(),
+		dropped: s.uploadDropped,
+	}
+	q.workers.Add(workers)
+	for i := 0; i < workers; i++ {
+		go func() {
+			defer q.workers.Done()
+			for f := range q.files {
+				if s.aborted() != nil {
+					q.dropped(f)
+					q.pending.Done()
+					continue
+				}
+				s.busy(1)
+				s.uploadFile(s3Svc, q, f)
+				s.busy(-1)
+				q.pending.Done()
+			}
+		}()
+	}
+	return q
+}
 
-		return true
+// filterPath reports whether the file at path should not be uploaded.
+func (s *S3Sync) filterPath(path string, info os.FileInfo) bool {
+	if s.CopySymlinks && info.Mode()&os.ModeSymlink != 0 {
+		return s.excludeFile(path)
 	}
+	if info.Mode().IsRegular() {
+		return s.excludeFile(path)
+	}
+
+	return true
+}
 
-	err = filepath.Walk(source, func(path string, info os.FileInfo, err error) error {
+// walkLocal queues every file below dir that differs from bucketIndex and
+// returns the set of keys it saw. Keys are relative to source. The inputs of
+// the keys are only kept when a manifest needs them.
+func (s *S3Sync) walkLocal(source, dir, bucket, prefix string, bucketIndex S3KeyMap, q *uploadQueue) map[string]*localToS3Input {
+	seen := make(map[string]*localToS3Input)
+	s.walkFiles(source, dir, func(path, relPath string, info os.FileInfo) {
+		s.queueFile(path, relPath, info, bucket, prefix, bucketIndex, q, seen)
+	})
+	return seen
+}
+
+// walkFiles calls fn for every file below dir that is not excluded, with its
+// path relative to source, until the sync is aborted.
+func (s *S3Sync) walkFiles(source, dir string, fn func(path, relPath string, info os.FileInfo)) {
+	err := filepath.Walk(dir, func(path string, info os.FileInfo, err error) error {
 		if err != nil {
 			log.Println(err)
 			return nil
 		}
-		if info.Mode().IsDir() && s.ExcludeDirectories[path] {
+		if err := s.aborted(); err != nil {
+			return err
+		}
+		if info.Mode().IsDir() && s.excludedDir(path) {
+			s.emit(Event{Event: EventSkipped, Path: path, Reason: "excluded-dir"})
 			return filepath.SkipDir
 		}
-		if filterPath(path, info) {
+		if s.filterPath(path, info) {
 			return nil
 		}
 
 		relPath, err := filepath.Rel(source, path)
-		key := prefix + relPath
+		fn(path, relPath, info)
+		return nil
+	})
+	if err != nil && err != s.aborted() {
+		log.Print(err)
+	}
+}
 
-		if info.Mode().IsRegular() && bucketIndex.ExistsSize(key, info.Size()) {
-			debug("Exists Size:", key)
-			return nil
+// queueList queues the files of FilesFrom, which are relative to source,
+// like walkLocal.
+func (s *S3Sync) queueList(source, bucket, prefix string, bucketIndex S3KeyMap, q *uploadQueue) map[string]*localToS3Input {
+	seen := make(map[string]*localToS3Input)
+	for _, relPath := range s.FilesFrom {
+		if s.aborted() != nil {
+			break
+		}
+		path := filepath.Join(source, relPath)
+		info, err := os.Lstat(path)
+		if err != nil {
+			log.Println(err)
+			continue
+		}
+		if s.filterPath(path, info) {
+			continue
 		}
+		s.queueFile(path, filepath.Clean(relPath), info, bucket, prefix, bucketIndex, q, seen)
+	}
+	return seen
+}
 
-		if info.Mode()&os.ModeSymlink != 0 {
-			target, err := os.Readlink(path)
-			if err != nil {
-				log.Println(err)
-				return nil
-			}
+// queueFile queues the file at path if it differs from bucketIndex and
+// records its key in seen.
+func (s *S3Sync) queueFile(path, relPath string, info os.FileInfo, bucket, prefix string, bucketIndex S3KeyMap, q *uploadQueue, seen map[string]*localToS3Input) {
+	key := prefix + relPath
+	seen[key] = nil
 
-			if bucketIndex.ExistsETAG(key, bytes.NewBufferString(target)) {
-				debug("Exists ETAG:", key)
-				return nil
+	in, err := s.newLocalToS3Input(path, relPath, bucket, key, info)
+	if err != nil {
+		log.Println(err)
+		return
+	}
+	if s.Manifest != "" {
+		seen[key] = in
+	}
+	if s.needsUpload(in, bucketIndex) {
+		q.add(in)
+	}
+}
+
+// uploadMetadata replaces the metadata of the existing object of in.
+func (s *S3Sync) uploadMetadata(s3Svc *s3.S3, q *uploadQueue, in *localToS3Input) {
+	key := *in.Params.Key
+	if s.DryRun {
+		s.dryRun("metadata", in)
+		return
+	}
+
+	start := time.Now()
+	s.emit(Event{Event: EventStarted, Action: "metadata", Key: key, Path: in.LocalPath})
+	if err := updateMetadata(s3Svc, in); err != nil {
+		log.Print(err)
+		s.uploadFailed(q, "metadata", in, err)
+		return
+	}
+	s.emit(Event{
+		Event:    EventCompleted,
+		Action:   "metadata",
+		Key:      key,
+		Path:     in.LocalPath,
+		Duration: time.Since(start).Seconds(),
+	})
+}
+
+// newLocalToS3Input builds the upload of the local file at path to key.
+func (s *S3Sync) newLocalToS3Input(path, relPath, bucket, key string, info os.FileInfo) (*localToS3Input, error) {
+	params := &s3.PutObjectInput{
+		Key:         aws.String(key),
+		Bucket:      aws.String(bucket),
+		ContentType: aws.String(s.contentType(path, info)),
+		Metadata:    fileMetadata(info),
+	}
+	if s.StorageClass != "" {
+		params.StorageClass = aws.String(s.StorageClass)
+	}
+	if s.ACL != "" {
+		params.ACL = aws.String(s.ACL)
+	}
+	tags := make(map[string]string)
+	for k, v := range s.Tags {
+		tags[k] = v
+	}
+	applyRules(s.Rules, relPath, params, tags)
+	s.SSE.applyPut(params)
+
+	in := &localToS3Input{
+		LocalPath: path,
+		RelPath:   relPath,
+		Params:    params,
+		Info:      info,
+		Tags:      tags,
+		Verify:    s.VerifyUploads,
+	}
+	if info.Mode()&os.ModeSymlink != 0 {
+		target, err := os.Readlink(path)
+		if err != nil {
+			return nil, err
+		}
+		in.SymlinkTarget = target
+	}
+	if info.Mode().IsRegular() {
+		in.Snapshot = s.SnapshotSize > 0 && info.Size() <= s.SnapshotSize
+		if s.Encryption != nil {
+			in.Encryption = s.Encryption
+		} else {
+			if params.ContentEncoding == nil && s.compressFile(relPath) {
+				in.Compress = s.Compression
 			}
 		}
+	}
+	return in, nil
+}
+
+// needsUpload compares in against the bucket index. It returns false if the
+// object is known to be up to date, otherwise it records what the worker has
+// to verify before uploading.
+func (s *S3Sync) needsUpload(in *localToS3Input, bucketIndex S3KeyMap) bool {
+	key := *in.Params.Key
 
-		params := &s3.PutObjectInput{
-			Key:         aws.String(key),
-			Bucket:      aws.String(bucket),
-			ContentType: aws.String(ContentType(key)),
+	reason := ""
+	if in.Info.Mode().IsRegular() && bucketIndex.ExistsSize(key, in.Info.Size()) {
+		debug("Exists Size:", key)
+		reason = "size"
+	}
+
+	// The ETag of a symlink of the same size may differ because the object
+	// is encrypted with SSE-KMS or SSE-C, so the worker has to HEAD it.
+	verifySymlink := false
+	if in.Info.Mode()&os.ModeSymlink != 0 {
+		if bucketIndex.ExistsETAG(key, bytes.NewBufferString(in.SymlinkTarget)) {
+			debug("Exists ETAG:", key)
+			reason = "etag"
+		} else {
+			verifySymlink = bucketIndex.ExistsSize(key, int64(len(in.SymlinkTarget)))
 		}
+	}
 
-		fileChan <- &localToS3Input{LocalPath: path, Params: params, Info: info}
-		return nil
-	})
-	close(fileChan)
+	if in.Encryption != nil {
+		reason = ""
+	}
+	contentMatches := reason != ""
+	in.Exists = bucketIndex.Exists(key)
+	in.Remote = bucketIndex[key]
+	if prev := s.copyIndex[key]; prev != nil && !in.Exists {
+		in.CopyFrom = *prev.Key
+	}
+	in.ContentMatches = contentMatches
+	in.VerifyOriginal = (in.Compress != "" || in.Encryption != nil || verifySymlink) && !contentMatches && in.Exists
+
+	// An unchanged file is HEADed if the rules matching it changed, so
+	// headers set by a rule that was since changed or removed are reset.
+	if contentMatches && !s.UpdateMetadata && !s.rulesChanged(in.RelPath) {
+		s.emit(Event{Event: EventSkipped, Key: key, Path: in.LocalPath, Reason: reason})
+		s.plan.addUnchanged(in)
+		return false
+	}
+	s.emit(Event{Event: EventPlanned, Key: key, Path: in.LocalPath, Bytes: in.size()})
+	return true
+}
 
+// uploadFile uploads in, or only updates its metadata if the worker finds
+// the content already up to date.
+func (s *S3Sync) uploadFile(s3Svc *s3.S3, q *uploadQueue, in *localToS3Input) {
+	key := *in.Params.Key
+	if in.MetadataOnly {
+		s.uploadMetadata(s3Svc, q, in)
+		return
+	}
+	if in.CopyFrom != "" && s.copyUnchanged(s3Svc, q, in) {
+		return
+	}
+	if in.ContentMatches || in.VerifyOriginal {
+		content, metadata, err := compareRemote(s3Svc, in)
+		if err != nil {
+			log.Print(err)
+			s.uploadFailed(q, "head", in, err)
+			return
+		}
+		if content && metadata {
+			s.emit(Event{Event: EventSkipped, Key: key, Path: in.LocalPath, Reason: "metadata"})
+			s.plan.addUnchanged(in)
+			return
+		}
+		if content {
+			s.uploadMetadata(s3Svc, q, in)
+			return
+		}
+	}
+
+	if s.DryRun {
+		if in.Exists {
+			s.dryRun("update", in)
+		} else {
+			s.dryRun("new", in)
+		}
+		return
+	}
+
+	start := time.Now()
+	log.Println("START:", in.LocalPath, key)
+	s.emit(Event{Event: EventStarted, Action: "upload", Key: key, Path: in.LocalPath})
+
+	etag, err := s.uploadStable(s3Svc, in)
 	if err != nil {
 		log.Print(err)
+		s.uploadFailed(q, "upload", in, err)
+	} else {
+		s.emit(Event{
+			Event:    EventCompleted,
+			Action:   "upload",
+			Key:      key,
+			Path:     in.LocalPath,
+			Bytes:    in.size(),
+			Duration: time.Since(start).Seconds(),
+			ETag:     etag,
+		})
 	}
 
-	wg.Wait()
-
-	return nil
+	log.Printf("DONE (%s): %s %s", time.Since(start), in.LocalPath, key)
 }
 
 func md5Sum(src io.Reader) string {
@@ -191,8 +609,27 @@ func md5Sum(src io.Reader) string {
 	return fmt.Sprintf("%x", h.Sum(nil))
 }
 
+func md5File(path string) (string, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return "", err
+	}
+	defer file.Close()
+
+	h := md5.New()
+	if _, err := io.Copy(h, file); err != nil {
+		return "", err
+	}
+	return fmt.Sprintf("%x", h.Sum(nil)), nil
+}
+
 type S3KeyMap map[string]*s3.Object
 
+func (s S3KeyMap) Exists(key string) bool {
+	_, ok := s[key]
+	return ok
+}
+
 func (s S3KeyMap) ExistsSize(key string, size int64) bool {
 	v, ok := s[key]
 	if !ok {
@@ -212,7 +649,10 @@ func (s S3KeyMap) ExistsETAG(key string, src io.Reader) bool {
 }
 
 func (s *S3Sync) bucketIndex(bucket, prefix string) (S3KeyMap, error) {
-	s3Svc := s3.New(s.AWSConfig)
+	s3Svc, err := s.client()
+	if err != nil {
+		return nil, err
+	}
 
 	keymap := make(S3KeyMap)
 	params := &s3.ListObjectsInput{
@@ -251,48 +691,134 @@ func (s *S3Sync) bucketIndex(bucket, prefix string) (S3KeyMap, error) {
 	return keymap, nil
 }
 
-func ContentType(path string) string {
-	if tmp := mime.TypeByExtension(filepath.Ext(path)); tmp != "" {
-		return tmp
-	}
-	return "application/octet-stream"
-}
-
 type localToS3Input struct {
-	LocalPath string
-	Params    *s3.PutObjectInput
-	Info      os.FileInfo
+	LocalPath      string
+	RelPath        string
+	Params         *s3.PutObjectInput
+	Info           os.FileInfo
+	SymlinkTarget  string
+	Tags           map[string]string
+	Compress       string
+	Encryption     *ClientEncryption
+	Exists         bool
+	ContentMatches bool
+	VerifyOriginal bool
+	Verify         bool
+	Snapshot       bool
+	Attempt        int
+	MetadataOnly   bool
+	Remote         *s3.Object
+
+	// CopyFrom is the key of an object that may hold the same content,
+	// which is copied instead of uploading the file if it does.
+	CopyFrom string
+
+	// BlobSHA256 is the sha256 the key is named after. The upload fails if
+	// the file no longer has it.
+	BlobSHA256 string
+
+	// SHA256 is the hex sha256 of the file, set once it has been read.
+	SHA256 string
 }
 
-func localToS3(s3Svc *s3.S3, in *localToS3Input) error {
-	metadata := make(map[string]*string)
+// localToS3 uploads in and returns the ETag of the new object.
+func localToS3(s3Svc *s3.S3, in *localToS3Input) (string, error) {
+	var sum, bodySHA256 []byte
+	var size int64
 	if in.Info.Mode()&os.ModeSymlink != 0 {
-		target, err := os.Readlink(in.LocalPath)
-		if err != nil {
-			return err
-		}
-		in.Params.Body = bytes.NewReader([]byte(target))
+		in.Params.Body = bytes.NewReader([]byte(in.SymlinkTarget))
+		in.SHA256 = sha256Hex(in.Params.Body)
+		in.Params.Body.Seek(0, 0)
 
 	} else if in.Info.Mode().IsRegular() {
 		file, err := os.Open(in.LocalPath)
 		if err != nil {
-			return err
+			return "", err
 		}
 		defer file.Close()
 
-		in.Params.Body = file
-	}
+		var src localFile = file
+		if in.Snapshot {
+			data, err := ioutil.ReadAll(file)
+			if err != nil {
+				return "", err
+			}
+			src = bytes.NewReader(data)
+		}
 
-	if stat_t, ok := in.Info.Sys().(*syscall.Stat_t); ok {
-		metadata["mode"] = aws.String(fmt.Sprint(stat_t.Mode))
-		metadata["uid"] = aws.String(fmt.Sprint(stat_t.Uid))
-		metadata["gid"] = aws.String(fmt.Sprint(stat_t.Gid))
+		if in.Encryption != nil {
+			// A single pass sums the ciphertext for the request and the
+			// plaintext for the metadata.
+			body, err := in.Encryption.encryptBody(in, src)
+			if err != nil {
+				return "", err
+			}
+			plain, mac := sha256.New(), in.Encryption.newMAC()
+			body.plain = io.MultiWriter(plain, mac)
+			sum, bodySHA256, size, err = sumFile(body)
+			body.plain = nil
+			if err != nil {
+				return "", err
+			}
+			in.SHA256 = fmt.Sprintf("%x", plain.Sum(nil))
+			in.Params.Metadata[metaOriginalMAC] = aws.String(fmt.Sprintf("%x", mac.Sum(nil)))
+		} else {
+			fileMD5, fileSHA256, fileSize, err := sumFile(src)
+			if err != nil {
+				return "", err
+			}
+			in.SHA256 = fmt.Sprintf("%x", fileSHA256)
+
+			in.Params.Body = src
+			if in.Compress != "" {
+				spool, err := compressBody(in, src, fileMD5)
+				if err != nil {
+					return "", err
+				}
+				if spool != nil {
+					defer removeSpool(spool)
+				}
+			}
+			if in.Params.Body == src {
+				sum, bodySHA256, size = fileMD5, fileSHA256, fileSize
+			}
+		}
+	}
+	// The plaintext sha256 of an encrypted object would tell which content
+	// it holds; originalMatches uses its keyed hmac instead.
+	if in.SHA256 != "" && in.Encryption == nil {
+		if in.Params.Metadata == nil {
+			in.Params.Metadata = make(map[string]*string)
+		}
+		in.Params.Metadata[metaSHA256] = aws.String(in.SHA256)
+	}
+	if in.BlobSHA256 != "" && in.SHA256 != in.BlobSHA256 {
+		return "", awserr.New("ContentChanged", in.LocalPath+" changed since it was hashed", nil)
 	}
 
-	if len(metadata) > 0 {
-		in.Params.Metadata = metadata
+	if sum == nil {
+		var err error
+		sum, bodySHA256, size, err = sumFile(in.Params.Body)
+		if err != nil {
+			return "", err
+		}
+	}
+	out, err := putObject(s3Svc, in.Params, in.Tags, sum, bodySHA256)
+	if err != nil {
+		return "", err
 	}
+	if in.Verify {
+		if err := verifyUpload(s3Svc, in.Params, size, sum); err != nil {
+			return "", err
+		}
+	}
+	return aws.StringValue(out.ETag), nil
+}
 
-	_, err := s3Svc.PutObject(in.Params)
-	return err
+// size returns the number of bytes read from the local file.
+func (in *localToS3Input) size() int64 {
+	if in.Info.Mode()&os.ModeSymlink != 0 {
+		return int64(len(in.SymlinkTarget))
+	}
+	return in.Info.Size()
 }
@@ -0,0 +1,371 @@
+package s3sync
+
+import (
+	"bytes"
+	"crypto/md5"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/s3"
+)
+
+// Snapshots are stored as <id>/ below the target, next to their manifest in
+// <id>.json.
+const (
+	snapshotVersion = 1
+	snapshotExt     = ".json"
+)
+
+// A Snapshot lists the files of a point in time copy of a directory and the
+// keys holding their content. Files that did not change since the previous
+// snapshot are not uploaded again but refer to the key they were stored in
+// before.
+type Snapshot struct {
+	Version int            `json:"version"`
+	ID      string         `json:"id"`
+	Created time.Time      `json:"created"`
+	Source  string         `json:"source"`
+	Prefix  string         `json:"prefix"`
+	Files   []SnapshotFile `json:"files"`
+}
+
+// A SnapshotFile is a file of a snapshot.
+type SnapshotFile struct {
+	manifestEntry
+	ModTime  time.Time         `json:"mtime"`
+	Metadata map[string]string `json:"metadata,omitempty"`
+}
+
+// Size returns the size of the files of sn and how much of it was uploaded
+// for sn, rather than referred to in earlier snapshots.
+func (sn *Snapshot) Size() (int64, int64) {
+	var total, stored int64
+	for _, f := range sn.Files {
+		total += f.Size
+		if strings.HasPrefix(f.Key, sn.Prefix) {
+			stored += f.Size
+		}
+	}
+	return total, stored
+}
+
+type byPath []SnapshotFile
+
+func (b byPath) Len() int           { return len(b) }
+func (b byPath) Swap(i, j int)      { b[i], b[j] = b[j], b[i] }
+func (b byPath) Less(i, j int) bool { return b[i].Path < b[j].Path }
+
+// stringMetadata returns fileMetadata with string values.
+func stringMetadata(info os.FileInfo) map[string]string {
+	metadata := make(map[string]string)
+	for k, v := range fileMetadata(info) {
+		metadata[k] = aws.StringValue(v)
+	}
+	return metadata
+}
+
+// unchanged reports whether the local file described by info and metadata
+// still is f.
+func (f *SnapshotFile) unchanged(info os.FileInfo, metadata map[string]string) bool {
+	if f.Size != info.Size() || !f.ModTime.Equal(info.ModTime()) || len(f.Metadata) != len(metadata) {
+		return false
+	}
+	for k, v := range metadata {
+		if f.Metadata[k] != v {
+			return false
+		}
+	}
+	return true
+}
+
+// restored reports whether info, of the file at path, describes f as
+// Restore leaves it, which does not restore owners. Symlinks get no mtime,
+// so they are compared by their target instead.
+func (f *SnapshotFile) restored(path string, info os.FileInfo) bool {
+	if f.Size != info.Size() || f.Metadata["mode"] != stringMetadata(info)["mode"] {
+		return false
+	}
+	if info.Mode()&os.ModeSymlink != 0 {
+		target, err := os.Readlink(path)
+		return err == nil && f.SHA256 != "" && sha256Hex(strings.NewReader(target)) == f.SHA256
+	}
+	return f.ModTime.Equal(info.ModTime())
+}
+
+// Snapshot uploads source into a new snapshot below target. Files whose size,
+// mtime and metadata did not change since the latest snapshot are not
+// uploaded again. The snapshot's manifest is only written if every file was.
+func (s *S3Sync) Snapshot(source, target string, workers int) (*Snapshot, error) {
+	if !isLocalPath(source) || !isS3Path(target) {
+		return nil, errors.New("Snapshots can only be made from a local directory to S3")
+	}
+	if err := s.SSE.Validate(); err != nil {
+		return nil, err
+	}
+	abs, err := filepath.Abs(source)
+	if err != nil {
+		return nil, err
+	}
+	s3url, err := parseS3Path(target)
+	if err != nil {
+		return nil, err
+	}
+	bucket, base := s3url.Host, cleanS3Path(s3url.Path)
+
+	s3Svc, err := s.client()
+	if err != nil {
+		return nil, err
+	}
+	ids, err := s.snapshotIDs(s3Svc, bucket, base)
+	if err != nil {
+		return nil, err
+	}
+	previous := make(map[string]SnapshotFile)
+	if len(ids) > 0 {
+		last, err := s.loadSnapshot(s3Svc, bucket, base, ids[len(ids)-1])
+		if err != nil {
+			return nil, err
+		}
+		for _, f := range last.Files {
+			previous[f.Path] = f
+		}
+	}
+
+	sn := &Snapshot{Version: snapshotVersion, Created: time.Now().UTC(), Source: abs}
+	sn.ID = sn.Created.Format(timeIDFormat)
+	if len(ids) > 0 && ids[len(ids)-1] >= sn.ID {
+		return nil, fmt.Errorf("snapshot %s already exists", ids[len(ids)-1])
+	}
+	sn.Prefix = base + sn.ID + "/"
+	prefix := sn.Prefix
+	log.Println("SNAPSHOT:", sn.ID)
+	defer s.emitSummary()
+
+	failed := s.Summary().Failed
+	var uploads []*localToS3Input
+	q := s.startUploaders(s3Svc, workers)
+	s.walkFiles(source, source, func(path, relPath string, info os.FileInfo) {
+		metadata := stringMetadata(info)
+		if f, ok := previous[filepath.ToSlash(relPath)]; ok && f.unchanged(info, metadata) {
+			s.emit(Event{Event: EventSkipped, Key: f.Key, Path: path, Reason: "unchanged"})
+			sn.Files = append(sn.Files, f)
+			return
+		}
+
+		in, err := s.newLocalToS3Input(path, relPath, bucket, prefix+relPath, info)
+		if err != nil {
+			log.Println(err)
+			s.emitFailed("upload", prefix+relPath, path, err)
+			return
+		}
+		s.emit(Event{Event: EventPlanned, Key: *in.Params.Key, Path: path, Bytes: in.size()})
+		uploads = append(uploads, in)
+		q.add(in)
+	})
+	q.wait()
+
+	if s.FailedList != "" {
+		if err := s.writeFailedList(); err != nil {
+			return nil, err
+		}
+	}
+	if err := s.aborted(); err != nil {
+		return nil, err
+	}
+	if n := s.Summary().Failed - failed; n > 0 {
+		return nil, fmt.Errorf("snapshot %s not written, %d files failed", sn.ID, n)
+	}
+
+	key := base + sn.ID + snapshotExt
+	if s.DryRun {
+		report("snapshot", key)
+		return sn, nil
+	}
+	for _, in := range uploads {
+		// The sha256 of a file encrypted client side would give its
+		// plaintext away.
+		sum := ""
+		if in.Encryption == nil {
+			if sum, err = fileSHA256(in); err != nil {
+				return nil, err
+			}
+		}
+		sn.Files = append(sn.Files, SnapshotFile{
+			manifestEntry: manifestEntry{
+				Path:   filepath.ToSlash(in.RelPath),
+				Key:    *in.Params.Key,
+				Size:   in.Info.Size(),
+				SHA256: sum,
+			},
+			ModTime:  in.Info.ModTime(),
+			Metadata: stringMetadata(in.Info),
+		})
+	}
+	sort.Sort(byPath(sn.Files))
+	return sn, s.putJSON(s3Svc, bucket, key, sn)
+}
+
+// Snapshots returns the snapshots below target, oldest first.
+func (s *S3Sync) Snapshots(target string) ([]*Snapshot, error) {
+	s3url, err := parseS3Path(target)
+	if err != nil {
+		return nil, err
+	}
+	bucket, base := s3url.Host, cleanS3Path(s3url.Path)
+
+	s3Svc, err := s.client()
+	if err != nil {
+		return nil, err
+	}
+	ids, err := s.snapshotIDs(s3Svc, bucket, base)
+	if err != nil {
+		return nil, err
+	}
+	snapshots := make([]*Snapshot, len(ids))
+	for i, id := range ids {
+		if snapshots[i], err = s.loadSnapshot(s3Svc, bucket, base, id); err != nil {
+			return nil, err
+		}
+	}
+	return snapshots, nil
+}
+
+// Restore downloads the files of snapshot id below target to dest, with
+// the mode and mtime they had. Files in dest that already match are left
+// alone, as are files that are not part of the snapshot.
+func (s *S3Sync) Restore(target, id, dest string, workers int) error {
+	if err := validID(id); err != nil {
+		return err
+	}
+	if err := s.SSE.Validate(); err != nil {
+		return err
+	}
+	s3url, err := parseS3Path(target)
+	if err != nil {
+		return err
+	}
+	bucket, base := s3url.Host, cleanS3Path(s3url.Path)
+
+	s3Svc, err := s.client()
+	if err != nil {
+		return err
+	}
+	sn, err := s.loadSnapshot(s3Svc, bucket, base, id)
+	if err != nil {
+		return err
+	}
+	defer s.emitSummary()
+
+	failed := s.Summary().Failed
+	keyChan, wg := s.startDownloaders(s3Svc, workers)
+	for _, f := range sn.Files {
+		if s.aborted() != nil {
+			break
+		}
+		path, err := localPath(dest, f.Path)
+		if err != nil {
+			log.Println(err)
+			s.emitFailed("download", f.Key, "", err)
+			continue
+		}
+		if info, err := os.Lstat(path); err == nil && f.restored(path, info) {
+			s.emit(Event{Event: EventSkipped, Key: f.Key, Path: path, Reason: "unchanged"})
+			continue
+		}
+
+		s.emit(Event{Event: EventPlanned, Key: f.Key, Path: path, Bytes: f.Size})
+		keyChan <- &s3ToLocalInput{LocalPath: path, Root: dest, Params: s.getParams(bucket, f.Key), ModTime: f.ModTime}
+	}
+	close(keyChan)
+	wg.Wait()
+
+	if err := s.aborted(); err != nil {
+		return err
+	}
+	if n := s.Summary().Failed - failed; n > 0 {
+		return fmt.Errorf("%d files of snapshot %s could not be restored", n, id)
+	}
+	return nil
+}
+
+// snapshotIDs returns the ids of the snapshots below base, oldest first.
+func (s *S3Sync) snapshotIDs(s3Svc *s3.S3, bucket, base string) ([]string, error) {
+	var ids []string
+	err := s3Svc.ListObjectsPages(&s3.ListObjectsInput{
+		Bucket:    aws.String(bucket),
+		Prefix:    aws.String(base),
+		Delimiter: aws.String("/"),
+	}, func(page *s3.ListObjectsOutput, last bool) bool {
+		for _, o := range page.Contents {
+			name := strings.TrimPrefix(aws.StringValue(o.Key), base)
+			if !strings.HasSuffix(name, snapshotExt) {
+				continue
+			}
+			id := strings.TrimSuffix(name, snapshotExt)
+			if _, err := time.Parse(timeIDFormat, id); err == nil {
+				ids = append(ids, id)
+			}
+		}
+		return true
+	})
+	sort.Strings(ids)
+	return ids, err
+}
+
+func (s *S3Sync) loadSnapshot(s3Svc *s3.S3, bucket, base, id string) (*Snapshot, error) {
+	key := base + id + snapshotExt
+	sn := new(Snapshot)
+	if err := s.getJSON(s3Svc, bucket, key, sn); err != nil {
+		return nil, err
+	}
+	if sn.Version != snapshotVersion {
+		return nil, fmt.Errorf("%s: unsupported snapshot version %d", key, sn.Version)
+	}
+	return sn, nil
+}
+
+// getJSON decodes the JSON object key into v.
+func (s *S3Sync) getJSON(s3Svc *s3.S3, bucket, key string, v interface{}) error {
+	resp, err := s3Svc.GetObject(s.getParams(bucket, key))
+	if err != nil {
+		return fmt.Errorf("%s: %v", key, err)
+	}
+	defer resp.Body.Close()
+
+	if err := json.NewDecoder(resp.Body).Decode(v); err != nil {
+		return fmt.Errorf("%s: %v", key, err)
+	}
+	return nil
+}
+
+// putJSON uploads v as the JSON object key.
+func (s *S3Sync) putJSON(s3Svc *s3.S3, bucket, key string, v interface{}) error {
+	data, err := json.Marshal(v)
+	if err != nil {
+		return err
+	}
+	params := &s3.PutObjectInput{
+		Bucket:      aws.String(bucket),
+		Key:         aws.String(key),
+		ContentType: aws.String("application/json"),
+		Body:        bytes.NewReader(data),
+	}
+	s.SSE.applyPut(params)
+
+	log.Println("MANIFEST:", key)
+	sum := md5.Sum(data)
+	if _, err := putObject(s3Svc, params, nil, sum[:], nil); err != nil {
+		s.emitFailed("manifest", key, "", err)
+		return err
+	}
+	s.emit(Event{Event: EventCompleted, Action: "manifest", Key: key, Bytes: int64(len(data))})
+	return nil
+}
@@ -0,0 +1,118 @@
+package s3sync
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestSnapshotFileUnchanged(t *testing.T) {
+	mtime := time.Date(2015, 8, 27, 10, 0, 0, 0, time.UTC)
+	f := &SnapshotFile{
+		manifestEntry: manifestEntry{Path: "a.txt", Size: 3},
+		ModTime:       mtime,
+		Metadata:      map[string]string{"mode": "33188", "uid": "0", "gid": "0"},
+	}
+	info := testFileInfo{name: "a.txt", size: 3, mod: mtime.Local()}
+
+	tests := []struct {
+		name     string
+		info     os.FileInfo
+		metadata map[string]string
+		want     bool
+	}{
+		{"same", info, map[string]string{"mode": "33188", "uid": "0", "gid": "0"}, true},
+		{"size", testFileInfo{name: "a.txt", size: 4, mod: mtime}, f.Metadata, false},
+		{"mtime", testFileInfo{name: "a.txt", size: 3, mod: mtime.Add(time.Nanosecond)}, f.Metadata, false},
+		{"mode", info, map[string]string{"mode": "33261", "uid": "0", "gid": "0"}, false},
+		{"owner", info, map[string]string{"mode": "33188", "uid": "1000", "gid": "0"}, false},
+		{"missing metadata", info, map[string]string{"mode": "33188", "uid": "0"}, false},
+		{"extra metadata", info, map[string]string{"mode": "33188", "uid": "0", "gid": "0", "x": ""}, false},
+	}
+	for _, tt := range tests {
+		if got := f.unchanged(tt.info, tt.metadata); got != tt.want {
+			t.Errorf("%s: unchanged = %v, want %v", tt.name, got, tt.want)
+		}
+	}
+}
+
+func TestSnapshotFileRestored(t *testing.T) {
+	dir, err := ioutil.TempDir("", "s3sync")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	path := filepath.Join(dir, "a.txt")
+	if err := ioutil.WriteFile(path, []byte("abc"), 0640); err != nil {
+		t.Fatal(err)
+	}
+	mtime := time.Date(2015, 8, 27, 10, 0, 0, 0, time.UTC)
+	if err := os.Chtimes(path, mtime, mtime); err != nil {
+		t.Fatal(err)
+	}
+	info, err := os.Lstat(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	mode := stringMetadata(info)["mode"]
+
+	tests := []struct {
+		name string
+		f    SnapshotFile
+		want bool
+	}{
+		{"restored", SnapshotFile{manifestEntry{Size: 3}, mtime, map[string]string{"mode": mode}}, true},
+		{"owner is not restored", SnapshotFile{manifestEntry{Size: 3}, mtime, map[string]string{"mode": mode, "uid": "12345"}}, true},
+		{"size", SnapshotFile{manifestEntry{Size: 4}, mtime, map[string]string{"mode": mode}}, false},
+		{"mtime", SnapshotFile{manifestEntry{Size: 3}, mtime.Add(time.Second), map[string]string{"mode": mode}}, false},
+		{"mode", SnapshotFile{manifestEntry{Size: 3}, mtime, map[string]string{"mode": "33261"}}, false},
+	}
+	for _, tt := range tests {
+		if got := tt.f.restored(path, info); got != tt.want {
+			t.Errorf("%s: restored = %v, want %v", tt.name, got, tt.want)
+		}
+	}
+
+	link := filepath.Join(dir, "link")
+	if err := os.Symlink("a.txt", link); err != nil {
+		t.Fatal(err)
+	}
+	if info, err = os.Lstat(link); err != nil {
+		t.Fatal(err)
+	}
+	mode = stringMetadata(info)["mode"]
+	sum := sha256Hex(strings.NewReader("a.txt"))
+
+	links := []struct {
+		name string
+		f    SnapshotFile
+		want bool
+	}{
+		{"mtime is not restored", SnapshotFile{manifestEntry{Size: 5, SHA256: sum}, mtime, map[string]string{"mode": mode}}, true},
+		{"target", SnapshotFile{manifestEntry{Size: 5, SHA256: sha256Hex(strings.NewReader("b.txt"))}, mtime, map[string]string{"mode": mode}}, false},
+		{"no sha256", SnapshotFile{manifestEntry{Size: 5}, mtime, map[string]string{"mode": mode}}, false},
+	}
+	for _, tt := range links {
+		if got := tt.f.restored(link, info); got != tt.want {
+			t.Errorf("symlink %s: restored = %v, want %v", tt.name, got, tt.want)
+		}
+	}
+}
+
+func TestSnapshotSize(t *testing.T) {
+	sn := &Snapshot{
+		Prefix: "snaps/2/",
+		Files: []SnapshotFile{
+			{manifestEntry: manifestEntry{Key: "snaps/1/a", Size: 10}},
+			{manifestEntry: manifestEntry{Key: "snaps/2/b", Size: 5}},
+			{manifestEntry: manifestEntry{Key: "snaps/2/c", Size: 1}},
+		},
+	}
+	if total, stored := sn.Size(); total != 16 || stored != 6 {
+		t.Errorf("Size = %d, %d, want 16, 6", total, stored)
+	}
+}
@@ -0,0 +1,87 @@
+package s3sync
+
+import (
+	"bytes"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"strings"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/s3"
+)
+
+// SSE configures server-side encryption. Algorithm is AES256 or aws:kms;
+// CustomerKey enables SSE-C and excludes Algorithm.
+type SSE struct {
+	Algorithm   string
+	KMSKeyID    string
+	CustomerKey []byte
+}
+
+// LoadKey reads a 256 bit key, either raw or base64 encoded.
+func LoadKey(path string) ([]byte, error) {
+	key, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	if len(key) == 32 {
+		return key, nil
+	}
+
+	decoded, err := base64.StdEncoding.DecodeString(string(bytes.TrimSpace(key)))
+	if err != nil || len(decoded) != 32 {
+		return nil, fmt.Errorf("%s: key must be 32 bytes, raw or base64 encoded", path)
+	}
+	return decoded, nil
+}
+
+func (e *SSE) Validate() error {
+	switch e.Algorithm {
+	case "", s3.ServerSideEncryptionAes256, s3.ServerSideEncryptionAwsKms:
+	default:
+		return fmt.Errorf("unsupported server-side encryption %q", e.Algorithm)
+	}
+	if e.KMSKeyID != "" && e.Algorithm != s3.ServerSideEncryptionAwsKms {
+		return errors.New("a KMS key id requires aws:kms server-side encryption")
+	}
+	if e.CustomerKey != nil && e.Algorithm != "" {
+		return errors.New("SSE-C can not be combined with " + e.Algorithm)
+	}
+	return nil
+}
+
+// etagIsMD5 reports whether the ETag of an object stored with the given
+// server-side encryption is the md5 of its content, which is not the case
+// for SSE-KMS and SSE-C.
+func etagIsMD5(algorithm, customerAlgorithm *string) bool {
+	return aws.StringValue(algorithm) != s3.ServerSideEncryptionAwsKms && aws.StringValue(customerAlgorithm) == ""
+}
+
+// sseEqual reports whether the object described by head is stored with the
+// server-side encryption params asks for. Objects are left with the bucket's
+// default encryption unless params asks for one.
+func sseEqual(params *s3.PutObjectInput, head *s3.HeadObjectOutput) bool {
+	if params.ServerSideEncryption == nil {
+		return true
+	}
+	if *params.ServerSideEncryption != aws.StringValue(head.ServerSideEncryption) {
+		return false
+	}
+	// HEAD returns the ARN of the key, which ends in its id.
+	return params.SSEKMSKeyId == nil || strings.HasSuffix(aws.StringValue(head.SSEKMSKeyId), *params.SSEKMSKeyId)
+}
+
+func (e *SSE) applyPut(params *s3.PutObjectInput) {
+	if e.Algorithm != "" {
+		params.ServerSideEncryption = aws.String(e.Algorithm)
+	}
+	if e.KMSKeyID != "" {
+		params.SSEKMSKeyId = aws.String(e.KMSKeyID)
+	}
+	if e.CustomerKey != nil {
+		params.SSECustomerAlgorithm = aws.String(s3.ServerSideEncryptionAes256)
+		params.SSECustomerKey = aws.String(string(e.CustomerKey))
+	}
+}
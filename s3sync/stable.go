@@ -0,0 +1,78 @@
+package s3sync
+
+import (
+	"io"
+	"log"
+	"os"
+	"syscall"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/aws/aws-sdk-go/service/s3"
+)
+
+// DefaultUnstableRetries is how many times a file that changes while it is
+// uploaded is uploaded again by default.
+const DefaultUnstableRetries = 3
+
+// localFile is the contents of a local file, open or snapshotted in memory.
+type localFile interface {
+	io.ReadSeeker
+	io.ReaderAt
+}
+
+// uploadStable uploads in and then checks that the file did not change while
+// it was read. A file that did is uploaded again, up to UnstableRetries times,
+// whether or not its upload failed. If it never stops changing, a new object
+// holding a torn read is deleted again; an existing one is left for the next
+// sync to replace, as its ETag no longer matches the file.
+func (s *S3Sync) uploadStable(s3Svc *s3.S3, in *localToS3Input) (string, error) {
+	for attempt := 0; ; attempt++ {
+		etag, uploadErr := localToS3(s3Svc, in)
+
+		// A file that grows while it is read can also fail the request.
+		info, err := os.Lstat(in.LocalPath)
+		if err != nil {
+			if uploadErr != nil {
+				return "", uploadErr
+			}
+			return "", err
+		}
+		if sameFile(in.Info, info) {
+			return etag, uploadErr
+		}
+		if attempt >= s.UnstableRetries {
+			if uploadErr == nil && !in.Exists {
+				s3Svc.DeleteObject(&s3.DeleteObjectInput{Bucket: in.Params.Bucket, Key: in.Params.Key})
+			}
+			return "", awserr.New("UnstableFile", in.LocalPath+" kept changing while it was uploaded", nil)
+		}
+
+		log.Println("CHANGED:", in.LocalPath)
+		next, err := s.newLocalToS3Input(in.LocalPath, in.RelPath, aws.StringValue(in.Params.Bucket), aws.StringValue(in.Params.Key), info)
+		if err != nil {
+			return "", err
+		}
+		// Only what depends on the file changes. in keeps its attempts and
+		// what is known about the object, and the manifest holds on to it.
+		in.Info = info
+		in.SymlinkTarget = next.SymlinkTarget
+		in.Snapshot = next.Snapshot
+		in.SHA256 = ""
+		in.Params.ContentType = next.Params.ContentType
+		in.Params.Metadata = next.Params.Metadata
+	}
+}
+
+// sameFile reports whether a and b have the same size, mtime and inode.
+func sameFile(a, b os.FileInfo) bool {
+	if a.Size() != b.Size() || !a.ModTime().Equal(b.ModTime()) {
+		return false
+	}
+	as, aok := a.Sys().(*syscall.Stat_t)
+	bs, bok := b.Sys().(*syscall.Stat_t)
+	if aok && bok {
+		return as.Dev == bs.Dev && as.Ino == bs.Ino
+	}
+	return true
+}
@@ -0,0 +1,111 @@
+package s3sync
+
+import (
+	"encoding/base64"
+	"encoding/hex"
+	"fmt"
+	"net/url"
+	"strconv"
+	"strings"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/request"
+	"github.com/aws/aws-sdk-go/service/s3"
+)
+
+// ParseTag parses a key=value tag.
+func ParseTag(tag string) (string, string, error) {
+	parts := strings.SplitN(tag, "=", 2)
+	if len(parts) != 2 || parts[0] == "" {
+		return "", "", fmt.Errorf("invalid tag %q, expected key=value", tag)
+	}
+	return parts[0], parts[1], nil
+}
+
+// putObject uploads params, sending tags in the x-amz-tagging header so they
+// are set atomically with the object. S3 rejects the body unless its md5 is
+// sum. sha, if set, is the sha256 of the body.
+func putObject(s3Svc *s3.S3, params *s3.PutObjectInput, tags map[string]string, sum, sha []byte) (*s3.PutObjectOutput, error) {
+	req, out := s3Svc.PutObjectRequest(params)
+	contentMD5 := base64.StdEncoding.EncodeToString(sum)
+	req.Handlers.Build.PushBack(func(r *request.Request) {
+		r.HTTPRequest.Header.Set("Content-MD5", contentMD5)
+		// Saves the signer reading the body again to hash it.
+		if sha != nil {
+			r.HTTPRequest.Header.Set("X-Amz-Content-Sha256", hex.EncodeToString(sha))
+		}
+	})
+	if len(tags) > 0 {
+		tagging := encodeTags(tags)
+		req.Handlers.Build.PushBack(func(r *request.Request) {
+			r.HTTPRequest.Header.Set("x-amz-tagging", tagging)
+		})
+	}
+	return out, req.Send()
+}
+
+// copyObject copies an object as described by params, replacing the tags of
+// the source with tags.
+func copyObject(s3Svc *s3.S3, params *s3.CopyObjectInput, tags map[string]string) (*s3.CopyObjectOutput, error) {
+	req, out := s3Svc.CopyObjectRequest(params)
+	tagging := encodeTags(tags)
+	req.Handlers.Build.PushBack(func(r *request.Request) {
+		r.HTTPRequest.Header.Set("x-amz-tagging-directive", "REPLACE")
+		if tagging != "" {
+			r.HTTPRequest.Header.Set("x-amz-tagging", tagging)
+		}
+	})
+	return out, req.Send()
+}
+
+// tagsEqual reports whether the object of in has in.Tags. count is the
+// x-amz-tagging-count of its HEAD; the tags are only fetched if it matches.
+func tagsEqual(s3Svc *s3.S3, in *localToS3Input, count string) (bool, error) {
+	if count == "" {
+		count = "0"
+	}
+	if count != strconv.Itoa(len(in.Tags)) {
+		return false, nil
+	}
+	if len(in.Tags) == 0 {
+		return true, nil
+	}
+	tags, err := objectTags(s3Svc, *in.Params.Bucket, *in.Params.Key)
+	if err != nil {
+		return false, err
+	}
+	for k, v := range in.Tags {
+		if tags[k] != v {
+			return false, nil
+		}
+	}
+	return true, nil
+}
+
+// objectTags returns the tags of an object. The SDK predates object tagging,
+// but the response has the same shape as that of GetBucketTagging.
+func objectTags(s3Svc *s3.S3, bucket, key string) (map[string]string, error) {
+	out := new(s3.GetBucketTaggingOutput)
+	req := s3Svc.NewRequest(&request.Operation{
+		Name:       "GetObjectTagging",
+		HTTPMethod: "GET",
+		HTTPPath:   "/{Bucket}/{Key+}?tagging",
+	}, &s3.HeadObjectInput{Bucket: aws.String(bucket), Key: aws.String(key)}, out)
+	if err := req.Send(); err != nil {
+		return nil, err
+	}
+	tags := make(map[string]string)
+	for _, tag := range out.TagSet {
+		tags[aws.StringValue(tag.Key)] = aws.StringValue(tag.Value)
+	}
+	return tags, nil
+}
+
+// encodeTags returns tags as the query string x-amz-tagging takes.
+func encodeTags(tags map[string]string) string {
+	values := make(url.Values)
+	for k, v := range tags {
+		values.Set(k, v)
+	}
+	return values.Encode()
+}
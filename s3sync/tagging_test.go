@@ -0,0 +1,97 @@
+package s3sync
+
+import (
+	"net/url"
+	"reflect"
+	"testing"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/s3"
+)
+
+func TestEncodeTags(t *testing.T) {
+	tests := []struct {
+		tags map[string]string
+		want string
+	}{
+		{nil, ""},
+		{map[string]string{"team": "web"}, "team=web"},
+		{map[string]string{"b": "2", "a": "1"}, "a=1&b=2"},
+		{map[string]string{"cost center": "a&b=c", "empty": ""}, "cost+center=a%26b%3Dc&empty="},
+	}
+	for _, tt := range tests {
+		got := encodeTags(tt.tags)
+		if got != tt.want {
+			t.Errorf("encodeTags(%v) = %q, want %q", tt.tags, got, tt.want)
+		}
+		values, err := url.ParseQuery(got)
+		if err != nil || len(values) != len(tt.tags) {
+			t.Errorf("encodeTags(%v) = %q does not parse back: %v", tt.tags, got, values)
+		}
+		for k, v := range tt.tags {
+			if values.Get(k) != v {
+				t.Errorf("encodeTags(%v): %s = %q, want %q", tt.tags, k, values.Get(k), v)
+			}
+		}
+	}
+}
+
+func TestTagsEqual(t *testing.T) {
+	s, stop := newTestS3(t, "bucket", map[string]testObject{
+		"a": {Tags: map[string]string{"team": "web", "env": "prod"}},
+	})
+	defer stop()
+	s3Svc, err := s.client()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name  string
+		tags  map[string]string
+		count string
+		want  bool
+	}{
+		{"no tags", map[string]string{}, "", true},
+		{"tags removed", map[string]string{}, "2", false},
+		{"tags added", map[string]string{"team": "web"}, "", false},
+		{"same tags", map[string]string{"team": "web", "env": "prod"}, "2", true},
+		{"changed value", map[string]string{"team": "ops", "env": "prod"}, "2", false},
+	}
+	for _, tt := range tests {
+		in := &localToS3Input{
+			Params: &s3.PutObjectInput{Bucket: aws.String("bucket"), Key: aws.String("a")},
+			Tags:   tt.tags,
+		}
+		got, err := tagsEqual(s3Svc, in, tt.count)
+		if err != nil || got != tt.want {
+			t.Errorf("%s: tagsEqual = %v, %v, want %v", tt.name, got, err, tt.want)
+		}
+	}
+
+	tags, err := objectTags(s3Svc, "bucket", "a")
+	if want := map[string]string{"team": "web", "env": "prod"}; err != nil || !reflect.DeepEqual(tags, want) {
+		t.Errorf("objectTags = %v, %v, want %v", tags, err, want)
+	}
+}
+
+func TestHeadersEqualStorageClass(t *testing.T) {
+	tests := []struct {
+		name         string
+		want, stored *string
+		equal        bool
+	}{
+		{"not requested", nil, aws.String("GLACIER"), true},
+		{"standard", aws.String("STANDARD"), nil, true},
+		{"same", aws.String("STANDARD_IA"), aws.String("STANDARD_IA"), true},
+		{"changed", aws.String("STANDARD_IA"), nil, false},
+		{"back to standard", aws.String("STANDARD"), aws.String("STANDARD_IA"), false},
+	}
+	for _, tt := range tests {
+		params := &s3.PutObjectInput{StorageClass: tt.want}
+		head := &s3.HeadObjectOutput{StorageClass: tt.stored}
+		if got := headersEqual(params, head); got != tt.equal {
+			t.Errorf("%s: headersEqual = %v, want %v", tt.name, got, tt.equal)
+		}
+	}
+}
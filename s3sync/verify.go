@@ -0,0 +1,42 @@
+package s3sync
+
+import (
+	"fmt"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/aws/aws-sdk-go/service/s3"
+)
+
+// verifyUpload checks that the object S3 stored for params has the size,
+// md5 and metadata that were sent.
+func verifyUpload(s3Svc *s3.S3, params *s3.PutObjectInput, size int64, sum []byte) error {
+	head, err := s3Svc.HeadObject(&s3.HeadObjectInput{
+		Bucket:               params.Bucket,
+		Key:                  params.Key,
+		SSECustomerAlgorithm: params.SSECustomerAlgorithm,
+		SSECustomerKey:       params.SSECustomerKey,
+	})
+	if err != nil {
+		return err
+	}
+
+	key := aws.StringValue(params.Key)
+	if got := aws.Int64Value(head.ContentLength); got != size {
+		return verifyError(key, fmt.Sprintf("size is %d, sent %d", got, size))
+	}
+	// The bucket's default encryption may apply even if params set none.
+	if etagIsMD5(head.ServerSideEncryption, head.SSECustomerAlgorithm) {
+		if got, want := aws.StringValue(head.ETag), fmt.Sprintf(`"%x"`, sum); got != want {
+			return verifyError(key, fmt.Sprintf("ETag is %s, sent md5 %s", got, want))
+		}
+	}
+	if !metadataEqual(params.Metadata, head.Metadata) {
+		return verifyError(key, "metadata differs from what was sent")
+	}
+	return nil
+}
+
+func verifyError(key, msg string) error {
+	return awserr.New("VerifyMismatch", key+": "+msg, nil)
+}
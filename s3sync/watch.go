@@ -0,0 +1,265 @@
+package s3sync
+
+import (
+	"log"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/s3"
+)
+
+// DefaultWatchDelay is how long a watched tree must be quiet before the
+// changes are uploaded.
+const DefaultWatchDelay = time.Second
+
+// watchMaxWait is how many delays a change waits at most when the tree is
+// never quiet.
+const watchMaxWait = 10
+
+type watchOp int
+
+const (
+	watchChanged watchOp = iota
+	watchRemoved
+	watchOverflow
+)
+
+type watchEvent struct {
+	Path string
+	Op   watchOp
+}
+
+// watch uploads source and then keeps uploading the paths that change below
+// it until the watcher fails.
+func (s *S3Sync) watch(s3Svc *s3.S3, source, bucket, prefix string, q *uploadQueue) error {
+	w, err := newWatcher()
+	if err != nil {
+		return err
+	}
+	defer w.close()
+
+	delay := s.WatchDelay
+	if delay <= 0 {
+		delay = DefaultWatchDelay
+	}
+
+	// Watch before the first pass so nothing written during it is missed.
+	s.watchTree(w, source)
+	if err := s.rescan(s3Svc, source, bucket, prefix, q); err != nil {
+		return err
+	}
+	log.Println("WATCHING:", source)
+
+	pending := make(map[string]watchOp)
+	overflow := false
+	var first time.Time
+	var settle <-chan time.Time
+	for {
+		select {
+		case e := <-w.events:
+			if e.Op == watchOverflow {
+				overflow = true
+			} else {
+				pending[e.Path] = e.Op
+			}
+			now := time.Now()
+			if first.IsZero() {
+				first = now
+			}
+			settle = time.After(settleDelay(first, now, delay))
+		case err := <-w.errors:
+			return err
+		case <-s.abortChan():
+			return s.aborted()
+		case <-settle:
+			settle = nil
+			if overflow {
+				log.Println("WATCH OVERFLOW: rescanning", source)
+				s.watchTree(w, source)
+				if err := s.rescan(s3Svc, source, bucket, prefix, q); err != nil {
+					log.Println(err)
+				}
+			} else {
+				var deletes []*s3.ObjectIdentifier
+				for path, op := range pending {
+					deletes = append(deletes, s.watchChange(w, s3Svc, source, path, op, bucket, prefix, q)...)
+				}
+				if err := s.watchDelete(s3Svc, bucket, prefix, deletes); err != nil {
+					log.Println(err)
+				}
+			}
+			overflow = false
+			first = time.Time{}
+			pending = make(map[string]watchOp)
+		}
+	}
+}
+
+// settleDelay returns how long to wait after an event at now for the tree
+// to be quiet, when the oldest pending event came at first. Changes are
+// flushed at most watchMaxWait delays after first even if events keep
+// coming.
+func settleDelay(first, now time.Time, delay time.Duration) time.Duration {
+	left := first.Add(watchMaxWait * delay).Sub(now)
+	if left < 0 {
+		return 0
+	}
+	if left < delay {
+		return left
+	}
+	return delay
+}
+
+// watchTree adds every directory below dir to the watcher.
+func (s *S3Sync) watchTree(w *watcher, dir string) {
+	filepath.Walk(dir, func(path string, info os.FileInfo, err error) error {
+		if err != nil || !info.IsDir() {
+			return nil
+		}
+		if s.excludedDir(path) {
+			return filepath.SkipDir
+		}
+		if err := w.add(path); err != nil {
+			log.Println("Error watching", path, err)
+		}
+		return nil
+	})
+}
+
+// rescan compares the whole tree with the bucket, deleting keys that no
+// longer have a file, other than those of excluded files, when WatchDelete
+// is set. The deletes are checked against MaxChanges and MaxChangesPercent
+// like those of a sync.
+func (s *S3Sync) rescan(s3Svc *s3.S3, source, bucket, prefix string, q *uploadQueue) error {
+	bucketIndex, err := s.bucketIndex(bucket, prefix)
+	if err != nil {
+		return err
+	}
+	seen := s.walkLocal(source, source, bucket, prefix, bucketIndex, q)
+	if !s.WatchDelete {
+		return nil
+	}
+
+	orphans := s.orphans(source, prefix, bucketIndex, seen)
+	if s.guarded() && len(orphans) > 0 {
+		if err := s.checkPlan(len(bucketIndex), nil, len(orphans)); err != nil {
+			return err
+		}
+	}
+	s.deleteKeys(s3Svc, bucket, orphans)
+	return nil
+}
+
+// watchChange queues the upload of a changed path, or returns the keys to
+// delete for a removed one.
+func (s *S3Sync) watchChange(w *watcher, s3Svc *s3.S3, source, path string, op watchOp, bucket, prefix string, q *uploadQueue) []*s3.ObjectIdentifier {
+	relPath, err := filepath.Rel(source, path)
+	if err != nil {
+		log.Println(err)
+		return nil
+	}
+	key := prefix + relPath
+
+	info, err := os.Lstat(path)
+	if os.IsNotExist(err) {
+		if op == watchRemoved && s.WatchDelete {
+			return s.removedKeys(source, bucket, prefix, key)
+		}
+		return nil
+	}
+	if err != nil {
+		log.Println(err)
+		return nil
+	}
+
+	if info.IsDir() {
+		if s.excludedDir(path) {
+			return nil
+		}
+		// Files created before the watch was added produce no events.
+		s.watchTree(w, path)
+		bucketIndex, err := s.bucketIndex(bucket, key+"/")
+		if err != nil {
+			log.Println(err)
+			return nil
+		}
+		s.walkLocal(source, path, bucket, prefix, bucketIndex, q)
+		return nil
+	}
+
+	if s.filterPath(path, info) {
+		return nil
+	}
+	bucketIndex, err := s.bucketIndex(bucket, key)
+	if err != nil {
+		log.Println(err)
+		return nil
+	}
+	in, err := s.newLocalToS3Input(path, relPath, bucket, key, info)
+	if err != nil {
+		log.Println(err)
+		return nil
+	}
+	if s.needsUpload(in, bucketIndex) {
+		q.add(in)
+	}
+	return nil
+}
+
+// removedKeys returns key and, if it was a directory, every key below it
+// that does not belong to an excluded file.
+func (s *S3Sync) removedKeys(source, bucket, prefix, key string) []*s3.ObjectIdentifier {
+	bucketIndex, err := s.bucketIndex(bucket, key)
+	if err != nil {
+		log.Println(err)
+		return nil
+	}
+
+	var batch []*s3.ObjectIdentifier
+	for k := range bucketIndex {
+		if k != key && !strings.HasPrefix(k, key+"/") {
+			continue
+		}
+		if s.excludedKey(source, strings.TrimPrefix(k, prefix)) {
+			debug("Excluded:", k)
+			continue
+		}
+		batch = append(batch, &s3.ObjectIdentifier{Key: aws.String(k)})
+	}
+	return batch
+}
+
+// watchDelete deletes the keys of the files removed while the tree was
+// quiet, unless they are more than MaxChanges or MaxChangesPercent of the
+// objects below prefix.
+func (s *S3Sync) watchDelete(s3Svc *s3.S3, bucket, prefix string, keys []*s3.ObjectIdentifier) error {
+	if len(keys) == 0 {
+		return nil
+	}
+	if s.guarded() {
+		bucketIndex, err := s.bucketIndex(bucket, prefix)
+		if err != nil {
+			return err
+		}
+		if err := s.checkPlan(len(bucketIndex), nil, len(keys)); err != nil {
+			return err
+		}
+	}
+	s.deleteKeys(s3Svc, bucket, keys)
+	return nil
+}
+
+// deleteKeys deletes keys in batches of the DeleteObjects limit.
+func (s *S3Sync) deleteKeys(s3Svc *s3.S3, bucket string, keys []*s3.ObjectIdentifier) {
+	for len(keys) > 0 {
+		n := len(keys)
+		if n > 1000 {
+			n = 1000
+		}
+		s.deleteObjects(s3Svc, bucket, keys[:n])
+		keys = keys[n:]
+	}
+}
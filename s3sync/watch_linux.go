@@ -0,0 +1,192 @@
+package s3sync
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"sync"
+	"syscall"
+	"unsafe"
+)
+
+const watchMask = syscall.IN_CLOSE_WRITE | syscall.IN_CREATE | syscall.IN_DELETE |
+	syscall.IN_MOVED_FROM | syscall.IN_MOVED_TO | syscall.IN_ATTRIB
+
+// watcher reports changes below the directories added to it using inotify.
+// The reader waits on the inotify fd and a wake pipe with epoll, so close can
+// stop it before the fds are closed.
+type watcher struct {
+	fd     int
+	epfd   int
+	wake   [2]int
+	events chan watchEvent
+	errors chan error
+	done   chan struct{}
+	exited chan struct{}
+
+	mu    sync.Mutex
+	paths map[int32]string
+}
+
+func newWatcher() (*watcher, error) {
+	fd, err := syscall.InotifyInit1(syscall.IN_CLOEXEC)
+	if err != nil {
+		return nil, os.NewSyscallError("inotify_init1", err)
+	}
+	w := &watcher{
+		fd:     fd,
+		epfd:   -1,
+		wake:   [2]int{-1, -1},
+		events: make(chan watchEvent, 1000),
+		errors: make(chan error, 1),
+		done:   make(chan struct{}),
+		exited: make(chan struct{}),
+		paths:  make(map[int32]string),
+	}
+	if err := w.init(); err != nil {
+		w.closeFds()
+		return nil, err
+	}
+	go w.read()
+	return w, nil
+}
+
+func (w *watcher) init() error {
+	if err := syscall.Pipe2(w.wake[:], syscall.O_CLOEXEC|syscall.O_NONBLOCK); err != nil {
+		return os.NewSyscallError("pipe2", err)
+	}
+	epfd, err := syscall.EpollCreate1(syscall.EPOLL_CLOEXEC)
+	if err != nil {
+		return os.NewSyscallError("epoll_create1", err)
+	}
+	w.epfd = epfd
+	for _, fd := range []int{w.fd, w.wake[0]} {
+		ev := syscall.EpollEvent{Events: syscall.EPOLLIN, Fd: int32(fd)}
+		if err := syscall.EpollCtl(epfd, syscall.EPOLL_CTL_ADD, fd, &ev); err != nil {
+			return os.NewSyscallError("epoll_ctl", err)
+		}
+	}
+	return nil
+}
+
+// add watches the directory dir. Adding a directory again updates its path.
+func (w *watcher) add(dir string) error {
+	wd, err := syscall.InotifyAddWatch(w.fd, dir, watchMask|syscall.IN_ONLYDIR)
+	if err != nil {
+		return os.NewSyscallError("inotify_add_watch", err)
+	}
+	w.mu.Lock()
+	w.paths[int32(wd)] = dir
+	w.mu.Unlock()
+	return nil
+}
+
+// close stops the reader and then closes the fds, so the reader never uses
+// an fd number that was closed and reused.
+func (w *watcher) close() error {
+	close(w.done)
+	syscall.Write(w.wake[1], []byte{0})
+	<-w.exited
+	return w.closeFds()
+}
+
+func (w *watcher) closeFds() error {
+	var err error
+	for _, fd := range []int{w.epfd, w.wake[0], w.wake[1], w.fd} {
+		if fd < 0 {
+			continue
+		}
+		if e := syscall.Close(fd); e != nil && err == nil {
+			err = os.NewSyscallError("close", e)
+		}
+	}
+	return err
+}
+
+func (w *watcher) read() {
+	defer close(w.exited)
+	var buf [syscall.SizeofInotifyEvent * 4096]byte
+	var ready [2]syscall.EpollEvent
+	for {
+		n, err := syscall.EpollWait(w.epfd, ready[:], -1)
+		if err == syscall.EINTR {
+			continue
+		}
+		if err != nil {
+			w.fail(os.NewSyscallError("epoll_wait", err))
+			return
+		}
+		for _, ev := range ready[:n] {
+			if int(ev.Fd) == w.wake[0] {
+				return
+			}
+		}
+
+		n, err = syscall.Read(w.fd, buf[:])
+		if err == syscall.EINTR {
+			continue
+		}
+		if err != nil {
+			w.fail(os.NewSyscallError("read", err))
+			return
+		}
+		if n < syscall.SizeofInotifyEvent {
+			w.fail(errors.New("inotify: short read"))
+			return
+		}
+
+		for offset := 0; offset+syscall.SizeofInotifyEvent <= n; {
+			raw := (*syscall.InotifyEvent)(unsafe.Pointer(&buf[offset]))
+			name := buf[offset+syscall.SizeofInotifyEvent : offset+syscall.SizeofInotifyEvent+int(raw.Len)]
+			offset += syscall.SizeofInotifyEvent + int(raw.Len)
+			w.handle(raw, string(trimNull(name)))
+		}
+	}
+}
+
+// send delivers e unless the watcher is being closed.
+func (w *watcher) send(e watchEvent) {
+	select {
+	case w.events <- e:
+	case <-w.done:
+	}
+}
+
+func (w *watcher) fail(err error) {
+	select {
+	case w.errors <- err:
+	case <-w.done:
+	}
+}
+
+func (w *watcher) handle(raw *syscall.InotifyEvent, name string) {
+	if raw.Mask&syscall.IN_Q_OVERFLOW != 0 {
+		w.send(watchEvent{Op: watchOverflow})
+		return
+	}
+
+	w.mu.Lock()
+	dir, ok := w.paths[raw.Wd]
+	if raw.Mask&syscall.IN_IGNORED != 0 {
+		delete(w.paths, raw.Wd)
+	}
+	w.mu.Unlock()
+	if !ok || name == "" {
+		return
+	}
+
+	op := watchChanged
+	if raw.Mask&(syscall.IN_DELETE|syscall.IN_MOVED_FROM) != 0 {
+		op = watchRemoved
+	}
+	w.send(watchEvent{Path: filepath.Join(dir, name), Op: op})
+}
+
+func trimNull(b []byte) []byte {
+	for i, c := range b {
+		if c == 0 {
+			return b[:i]
+		}
+	}
+	return b
+}
@@ -0,0 +1,19 @@
+//go:build !linux
+// +build !linux
+
+package s3sync
+
+import "errors"
+
+type watcher struct {
+	events chan watchEvent
+	errors chan error
+}
+
+func newWatcher() (*watcher, error) {
+	return nil, errors.New("--watch is only supported on Linux")
+}
+
+func (w *watcher) add(dir string) error { return nil }
+
+func (w *watcher) close() error { return nil }
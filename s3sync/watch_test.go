@@ -0,0 +1,28 @@
+package s3sync
+
+import (
+	"testing"
+	"time"
+)
+
+func TestSettleDelay(t *testing.T) {
+	first := time.Date(2015, 8, 27, 10, 0, 0, 0, time.UTC)
+	delay := time.Second
+
+	tests := []struct {
+		name  string
+		after time.Duration
+		want  time.Duration
+	}{
+		{"first event", 0, delay},
+		{"busy tree", 5 * time.Second, delay},
+		{"close to the limit", 9500 * time.Millisecond, 500 * time.Millisecond},
+		{"at the limit", 10 * time.Second, 0},
+		{"past the limit", time.Minute, 0},
+	}
+	for _, tt := range tests {
+		if got := settleDelay(first, first.Add(tt.after), delay); got != tt.want {
+			t.Errorf("%s: settleDelay = %v, want %v", tt.name, got, tt.want)
+		}
+	}
+}